@@ -0,0 +1,167 @@
+// Package analysis reads the documents that the OPSMX metric provider job writes in the messages of the
+// OpsmxAnalysis condition of its Job, and of the OpsmxInterval condition for an interval analysis.
+//
+//	for _, condition := range job.Status.Conditions {
+//		if condition.Type == analysis.ConditionType {
+//			details, err := analysis.Parse(condition.Message)
+//			...
+//		}
+//	}
+package analysis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// ConditionType is the type of the Job condition carrying the Details
+	ConditionType = "OpsmxAnalysis"
+	// IntervalConditionType is the type of the Job condition carrying the Interval last scored
+	IntervalConditionType = "OpsmxInterval"
+	// Version of the document written by this version of the job
+	Version = "v1"
+	// legacyHeader starts the plain text message of the jobs written before the document was versioned
+	legacyHeader = "analysisDetails"
+)
+
+// ErrNoDetails is returned for a message that is neither a document nor a legacy message, such as the
+// message of an error condition
+var ErrNoDetails = errors.New("the message does not carry analysis details")
+
+// Phases of an analysis
+const (
+	PhaseRunning      = "Running"
+	PhaseSuccessful   = "Successful"
+	PhaseFailed       = "Failed"
+	PhaseInconclusive = "Inconclusive"
+	PhaseError        = "Error"
+)
+
+// Details is the state of the canary analysis of a Job. Score is only set once the canary has been scored, and Error
+// once the analysis has ended in the Error phase.
+type Details struct {
+	Version      string     `json:"version"`
+	User         string     `json:"user,omitempty"`
+	CanaryId     string     `json:"canaryId,omitempty"`
+	ReportUrl    string     `json:"reportUrl,omitempty"`
+	ReportId     string     `json:"reportId,omitempty"`
+	Score        string     `json:"score,omitempty"`
+	Phase        string     `json:"phase,omitempty"`
+	RegisteredAt *time.Time `json:"registeredAt,omitempty"`
+	UpdatedAt    *time.Time `json:"updatedAt,omitempty"`
+	Services     []Service  `json:"services,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Service is the score ISD gave to a service of the serviceList
+type Service struct {
+	Name             string   `json:"name,omitempty"`
+	Gate             string   `json:"gate,omitempty"`
+	Score            string   `json:"score,omitempty"`
+	UnhealthyMetrics []string `json:"unhealthyMetrics,omitempty"`
+}
+
+// Interval is the score of the interval of an interval analysis that ISD has scored last
+type Interval struct {
+	Version    string     `json:"version"`
+	CanaryId   string     `json:"canaryId,omitempty"`
+	ReportUrl  string     `json:"reportUrl,omitempty"`
+	IntervalNo string     `json:"intervalNo"`
+	Score      string     `json:"score"`
+	ScoredAt   *time.Time `json:"scoredAt,omitempty"`
+}
+
+// Message renders the details as the message of the condition, in the current version
+func (d Details) Message() (string, error) {
+	d.Version = Version
+	return message(d)
+}
+
+// Message renders the interval as the message of the condition, in the current version
+func (i Interval) Message() (string, error) {
+	i.Version = Version
+	return message(i)
+}
+
+func message(document interface{}) (string, error) {
+	data, err := json.Marshal(document)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Unmarshal a document of the current version
+func parseDocument(message string, document interface{}) error {
+	if !strings.HasPrefix(message, "{") {
+		return ErrNoDetails
+	}
+	var header struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(message), &header); err != nil {
+		return fmt.Errorf("analysis details cannot be read: %w", err)
+	}
+	if header.Version != Version {
+		return fmt.Errorf("analysis details of version %q are not supported, expected %q", header.Version, Version)
+	}
+	if err := json.Unmarshal([]byte(message), document); err != nil {
+		return fmt.Errorf("analysis details cannot be read: %w", err)
+	}
+	return nil
+}
+
+// Parse reads the message of an OpsmxAnalysis condition. The plain text messages of the older jobs are read too,
+// with an empty Version.
+func Parse(message string) (Details, error) {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, legacyHeader) {
+		return parseLegacy(message), nil
+	}
+	var details Details
+	if err := parseDocument(message, &details); err != nil {
+		return Details{}, err
+	}
+	return details, nil
+}
+
+// ParseInterval reads the message of an OpsmxInterval condition
+func ParseInterval(message string) (Interval, error) {
+	var interval Interval
+	if err := parseDocument(strings.TrimSpace(message), &interval); err != nil {
+		return Interval{}, err
+	}
+	return interval, nil
+}
+
+// The legacy message is a header followed by one " key: value" line per field
+func parseLegacy(message string) Details {
+	var details Details
+	lines := strings.Split(message, "\n")
+	if lines[0] != legacyHeader {
+		return details
+	}
+	for _, line := range lines[1:] {
+		keyValue := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case "user":
+			details.User = keyValue[1]
+		case "canaryID":
+			details.CanaryId = keyValue[1]
+		case "reportURL":
+			details.ReportUrl = keyValue[1]
+		case "reportId":
+			details.ReportId = keyValue[1]
+		case "score":
+			details.Score = keyValue[1]
+		}
+	}
+	return details
+}
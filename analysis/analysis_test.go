@@ -0,0 +1,80 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	registeredAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	details := Details{
+		User:         "admin",
+		CanaryId:     "1424",
+		ReportUrl:    "https://isd.opsmx.net/report/1424",
+		ReportId:     "token-123",
+		Score:        "73",
+		Phase:        PhaseFailed,
+		RegisteredAt: &registeredAt,
+		Services: []Service{{
+			Name:             "backend",
+			Gate:             "gate1",
+			Score:            "65",
+			UnhealthyMetrics: []string{"backend/latency_p99"},
+		}},
+	}
+	message, err := details.Message()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"version":"v1","user":"admin","canaryId":"1424","reportUrl":"https://isd.opsmx.net/report/1424","reportId":"token-123","score":"73","phase":"Failed","registeredAt":"2023-05-01T10:00:00Z","services":[{"name":"backend","gate":"gate1","score":"65","unhealthyMetrics":["backend/latency_p99"]}]}`, message)
+
+	parsed, err := Parse(message)
+	assert.Equal(t, nil, err)
+	details.Version = Version
+	assert.Equal(t, details, parsed)
+}
+
+func TestParseLegacy(t *testing.T) {
+	parsed, err := Parse("analysisDetails\n user: admin\n canaryID: 1424\n reportURL: https://isd.opsmx.net/report/1424\n reportId: token-123\n score: 90")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Details{
+		User:      "admin",
+		CanaryId:  "1424",
+		ReportUrl: "https://isd.opsmx.net/report/1424",
+		ReportId:  "token-123",
+		Score:     "90",
+	}, parsed)
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse("analysis Error: POST /autopilot/api/v5/registerCanary returned 500 Internal Server Error")
+	assert.Equal(t, ErrNoDetails, err)
+
+	_, err = Parse(`{"version":"v2","canaryId":"1424"}`)
+	assert.Equal(t, `analysis details of version "v2" are not supported, expected "v1"`, err.Error())
+
+	_, err = Parse(`{"version":`)
+	assert.Equal(t, "analysis details cannot be read: unexpected end of JSON input", err.Error())
+}
+
+func TestParseInterval(t *testing.T) {
+	scoredAt := time.Date(2023, 5, 1, 10, 15, 0, 0, time.UTC)
+	interval := Interval{
+		CanaryId:   "1424",
+		ReportUrl:  "https://isd.opsmx.net/report/1424",
+		IntervalNo: "2",
+		Score:      "85",
+		ScoredAt:   &scoredAt,
+	}
+	message, err := interval.Message()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"version":"v1","canaryId":"1424","reportUrl":"https://isd.opsmx.net/report/1424","intervalNo":"2","score":"85","scoredAt":"2023-05-01T10:15:00Z"}`, message)
+
+	parsed, err := ParseInterval(message)
+	assert.Equal(t, nil, err)
+	interval.Version = Version
+	assert.Equal(t, interval, parsed)
+
+	_, err = ParseInterval(`{"version":"v2","intervalNo":"2"}`)
+	assert.Equal(t, `analysis details of version "v2" are not supported, expected "v1"`, err.Error())
+}
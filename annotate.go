@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotations of the canary on the AnalysisRun and Rollout owning the Job
+const (
+	annotationCanaryId  = "opsmx.io/canary-id"
+	annotationReportUrl = "opsmx.io/report-url"
+	annotationScore     = "opsmx.io/score"
+)
+
+// Merge patch of the annotations of cd. Until the canary is scored the score of a previous analysis is removed, a
+// null value deletes the annotation.
+func canaryAnnotationsPatch(cd CanaryDetails) ([]byte, error) {
+	annotations := map[string]interface{}{
+		annotationCanaryId:  cd.canaryId,
+		annotationReportUrl: cd.reportUrl,
+		annotationScore:     nil,
+	}
+	if cd.value != "" {
+		annotations[annotationScore] = cd.value
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+}
+
+// Annotate the AnalysisRun owning the Job and the Rollout owning the AnalysisRun with the canary of cd, so that
+// the report can be found from the Rollout. The annotations only point to the report, the analysis goes on
+// when they cannot be patched.
+func (c *Clients) annotateOwners(ctx context.Context, cd CanaryDetails) {
+	if c.kubeclientset == nil || c.argoclientset == nil || cd.jobName == "" {
+		return
+	}
+	owners := c.jobOwners(ctx, cd.jobName)
+	if owners.analysisRun == nil {
+		log.Debugf("the Job %s is not owned by an AnalysisRun, nothing to annotate", cd.jobName)
+		return
+	}
+	patch, err := canaryAnnotationsPatch(cd)
+	if err != nil {
+		log.Warnf("could not annotate the owners of the Job: %v", err)
+		return
+	}
+	_, err = c.argoclientset.ArgoprojV1alpha1().AnalysisRuns(owners.analysisRun.Namespace).Patch(ctx, owners.analysisRun.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		logAnnotationError("AnalysisRun", owners.analysisRun.Name, err)
+		return
+	}
+	if owners.rollout == nil {
+		return
+	}
+	_, err = c.argoclientset.ArgoprojV1alpha1().Rollouts(owners.rollout.Namespace).Patch(ctx, owners.rollout.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		logAnnotationError("Rollout", owners.rollout.Name, err)
+		return
+	}
+	log.Infof("annotated AnalysisRun %s and Rollout %s with canary ID %s", owners.analysisRun.Name, owners.rollout.Name, cd.canaryId)
+}
+
+func logAnnotationError(kind string, name string, err error) {
+	if k8serrors.IsForbidden(err) {
+		log.Warnf("the service account of the Job is not allowed to annotate the owners of the Job, %s %s: %v", kind, name, err)
+		return
+	}
+	log.Warnf("could not annotate the owners of the Job, %s %s: %v", kind, name, err)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	authModeBearer      = "bearer"
+	authModeApiKey      = "apiKey"
+	authModeBasic       = "basic"
+	defaultApiKeyHeader = "x-api-key"
+)
+
+// isdAuth holds the credentials sent to ISD along with x-spinnaker-user
+type isdAuth struct {
+	mode         string
+	token        string
+	apiKeyHeader string
+	apiKey       string
+	username     string
+	password     string
+}
+
+func newISDAuth(secretData map[string]string) isdAuth {
+	return isdAuth{
+		mode:         secretData["authMode"],
+		token:        secretData["token"],
+		apiKeyHeader: secretData["apiKeyHeader"],
+		apiKey:       secretData["apiKey"],
+		username:     secretData["username"],
+		password:     secretData["password"],
+	}
+}
+
+func (a isdAuth) apply(req *http.Request) {
+	switch a.mode {
+	case authModeBearer:
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case authModeApiKey:
+		req.Header.Set(a.apiKeyHeader, a.apiKey)
+	case authModeBasic:
+		req.SetBasicAuth(a.username, a.password)
+	}
+}
+
+// Read the credentials of the selected authMode from the secret, nothing is read when no authMode is set
+func getAuthSecret(secretsPath string) (map[string]string, error) {
+	authData := map[string]string{}
+	readKey := func(key string) (string, bool) {
+		data, err := os.ReadFile(filepath.Join(secretsPath, key))
+		if err != nil {
+			return "", false
+		}
+		return strings.TrimSpace(string(data)), true
+	}
+	requireKey := func(key string, mode string) error {
+		value, ok := readKey(key)
+		if !ok || value == "" {
+			errorMsg := fmt.Sprintf("opsmx profile secret validation error: `%s` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element '%s' for 'authMode' as '%s'", key, secretsPath, key, mode)
+			return errors.New(errorMsg)
+		}
+		authData[key] = value
+		return nil
+	}
+
+	authMode, _ := readKey("authMode")
+	switch authMode {
+	case "":
+		return authData, nil
+	case authModeBearer:
+		if err := requireKey("token", authMode); err != nil {
+			return nil, err
+		}
+	case authModeApiKey:
+		if err := requireKey("apiKey", authMode); err != nil {
+			return nil, err
+		}
+		authData["apiKeyHeader"] = defaultApiKeyHeader
+		if header, ok := readKey("apiKeyHeader"); ok && header != "" {
+			authData["apiKeyHeader"] = header
+		}
+	case authModeBasic:
+		if err := requireKey("username", authMode); err != nil {
+			return nil, err
+		}
+		if err := requireKey("password", authMode); err != nil {
+			return nil, err
+		}
+	default:
+		errorMsg := fmt.Sprintf("opsmx profile secret validation error: authMode should be one of %s, %s or %s", authModeBearer, authModeApiKey, authModeBasic)
+		return nil, errors.New(errorMsg)
+	}
+	authData["authMode"] = authMode
+	return authData, nil
+}
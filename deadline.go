@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	deadlinePolicyInconclusive = "Inconclusive"
+	deadlinePolicyError        = "Error"
+	defaultDeadlineGracePeriod = 5 * time.Minute
+)
+
+var errAnalysisDeadlineExceeded = errors.New("the analysis did not finish before its deadline")
+
+// DeadlinePolicy is how long past lifetimeMinutes and delay the job waits for the score of ISD, and how
+// the analysis ends when it is not there by then
+type DeadlinePolicy struct {
+	GracePeriod time.Duration `yaml:"gracePeriod,omitempty"`
+	OnTimeout   string        `yaml:"onTimeout,omitempty"`
+}
+
+func (p DeadlinePolicy) withDefaults() DeadlinePolicy {
+	if p.GracePeriod == 0 {
+		p.GracePeriod = defaultDeadlineGracePeriod
+	}
+	if p.OnTimeout == "" {
+		p.OnTimeout = deadlinePolicyInconclusive
+	}
+	return p
+}
+
+func (p DeadlinePolicy) errors() []error {
+	var errs []error
+	if p.GracePeriod < 0 {
+		errs = append(errs, errors.New("provider config map validation error: deadline gracePeriod cannot be negative"))
+	}
+	if p.OnTimeout != "" && p.OnTimeout != deadlinePolicyInconclusive && p.OnTimeout != deadlinePolicyError {
+		errorMsg := fmt.Sprintf("provider config map validation error: deadline onTimeout should be either %s or %s", deadlinePolicyInconclusive, deadlinePolicyError)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	return errs
+}
+
+// Time by which the analysis has to be over, the grace period past the end of its window
+func (metric *OPSMXMetric) analysisDeadline() time.Time {
+	return metric.windowEnd().Add(metric.Deadline.withDefaults().GracePeriod)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Render the registerCanary payload and the gitops templates without sending anything to ISD
+func dryRun(c *Clients, paths ConfigPaths, out io.Writer) error {
+	c.dryRun = true
+	log.Info("starting the getAnalysisTemplateData function")
+	metric, err := getAnalysisTemplateData(paths.providerConfig)
+	if err != nil {
+		return err
+	}
+	if metric.Application == "" {
+		return errors.New("provider config map validation error: application has to be set in the provider config map or through the APP_NAME environment variable for a dry run")
+	}
+	log.Info("performing basic checks")
+	err = metric.basicChecks()
+	if err != nil {
+		return err
+	}
+	log.Info("getting the data from the secret")
+	secretData, err := metric.getDataSecret(paths.secrets)
+	if err != nil {
+		return err
+	}
+	err = metric.getTimeVariables()
+	if err != nil {
+		return err
+	}
+	log.Info("generating the payload")
+	payload, err := metric.generatePayload(context.Background(), c, secretData, paths.templates)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range c.templates {
+		fmt.Fprintf(out, "# gitops %s template %s\n%s\n", template.templateType, template.name, string(template.data))
+	}
+	fmt.Fprintf(out, "# registerCanary payload\n%s\n", payload)
+	return nil
+}
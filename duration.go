@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// configDuration is a duration of the provider config, either a Go duration such as 30s or a bare number of
+// seconds, which is how a duration is naturally written in the JSON configs of the plugin and the server
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds float64
+	if err := unmarshal(&seconds); err == nil {
+		*d = configDuration(seconds * float64(time.Second))
+		return nil
+	}
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		*d = configDuration(seconds * float64(time.Second))
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected a number of seconds or a duration such as 30s", value)
+	}
+	*d = configDuration(duration)
+	return nil
+}
+
+func (p *PollPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Interval       configDuration `yaml:"interval"`
+		Backoff        float64        `yaml:"backoff"`
+		MaxInterval    configDuration `yaml:"maxInterval"`
+		InterimResults bool           `yaml:"interimResults"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*p = PollPolicy{
+		Interval:       time.Duration(raw.Interval),
+		Backoff:        raw.Backoff,
+		MaxInterval:    time.Duration(raw.MaxInterval),
+		InterimResults: raw.InterimResults,
+	}
+	return nil
+}
+
+func (p *RetryPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Attempts  int            `yaml:"attempts"`
+		BaseDelay configDuration `yaml:"baseDelay"`
+		MaxDelay  configDuration `yaml:"maxDelay"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*p = RetryPolicy{
+		Attempts:  raw.Attempts,
+		BaseDelay: time.Duration(raw.BaseDelay),
+		MaxDelay:  time.Duration(raw.MaxDelay),
+	}
+	return nil
+}
+
+func (p *DeadlinePolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		GracePeriod configDuration `yaml:"gracePeriod"`
+		OnTimeout   string         `yaml:"onTimeout"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*p = DeadlinePolicy{
+		GracePeriod: time.Duration(raw.GracePeriod),
+		OnTimeout:   raw.OnTimeout,
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const eventComponent = "opsmx-metric-provider-job"
+
+// Reasons of the events recorded along the analysis
+const (
+	EventReasonConfigValidated   = "ConfigValidated"
+	EventReasonTemplatesSynced   = "TemplatesSynced"
+	EventReasonCanaryRegistered  = "CanaryRegistered"
+	EventReasonCanaryResumed     = "CanaryResumed"
+	EventReasonIntervalScored    = "IntervalScored"
+	EventReasonAnalysisCompleted = "AnalysisCompleted"
+	EventReasonAnalysisCancelled = "AnalysisCancelled"
+	EventReasonAnalysisError     = "AnalysisError"
+)
+
+// Record an event of the analysis of cd on the Job and its AnalysisRun. Events only tell the story of the
+// analysis, a failure to record them is logged and the analysis goes on.
+func (c *Clients) recordEvent(ctx context.Context, cd CanaryDetails, eventType string, reason string, message string) {
+	if cd.canaryId != "" {
+		message = fmt.Sprintf("%s, canary ID %s", message, cd.canaryId)
+	}
+	if cd.reportUrl != "" {
+		message = fmt.Sprintf("%s, report URL %s", message, cd.reportUrl)
+	}
+	//without kubernetes the events are only logged
+	if c.kubeclientset == nil || cd.jobName == "" {
+		log.Infof("event %s: %s", reason, message)
+		return
+	}
+	objects := c.jobOwners(ctx, cd.jobName).eventObjects()
+	if len(objects) == 0 {
+		log.Infof("event %s: %s", reason, message)
+		return
+	}
+	now := metav1.NewTime(time.Now())
+	for _, object := range objects {
+		event := &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+				Namespace: object.Namespace,
+			},
+			InvolvedObject: object,
+			Reason:         reason,
+			Message:        message,
+			Type:           eventType,
+			Source:         corev1.EventSource{Component: eventComponent},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          1,
+		}
+		if _, err := c.kubeclientset.CoreV1().Events(object.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+			log.Warnf("could not record the %s event on %s %s: %v", reason, object.Kind, object.Name, err)
+		}
+	}
+}
+
+// Record the end of an analysis scored by ISD, as a warning unless it is Successful
+func (c *Clients) recordAnalysisCompleted(ctx context.Context, cd CanaryDetails, detail string) {
+	eventType := corev1.EventTypeWarning
+	if cd.phase == AnalysisPhaseSuccessful {
+		eventType = corev1.EventTypeNormal
+	}
+	message := fmt.Sprintf("the analysis is %s with score %s", cd.phase, cd.value)
+	if detail != "" {
+		message = fmt.Sprintf("%s: %s", message, detail)
+	}
+	c.recordEvent(ctx, cd, eventType, EventReasonAnalysisCompleted, message)
+}
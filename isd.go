@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ISDClient is the part of the ISD autopilot API used by the analysis
+type ISDClient interface {
+	RegisterCanary(ctx context.Context, req RegisterCanaryRequest) (RegisterCanaryResponse, error)
+	GetCanaryStatus(ctx context.Context, req CanaryStatusRequest) (CanaryStatusResponse, error)
+	VerifyTemplate(ctx context.Context, req TemplateRequest) (bool, error)
+	SaveTemplate(ctx context.Context, req TemplateRequest) (SaveTemplateResponse, error)
+	CancelCanary(ctx context.Context, req CancelCanaryRequest) error
+}
+
+// RegisterCanaryRequest carries the jobPayload rendered by generatePayload
+type RegisterCanaryRequest struct {
+	Payload string
+}
+
+type RegisterCanaryResponse struct {
+	CanaryId json.Number `json:"canaryId,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Message  string      `json:"message,omitempty"`
+	//taken from the Location and x-opsmx-report-token headers
+	ScoreUrl    string `json:"-"`
+	ReportToken string `json:"-"`
+}
+
+// CanaryStatusRequest looks up a canary by its score url when known, by its ID otherwise
+type CanaryStatusRequest struct {
+	CanaryId    string
+	ScoreUrl    string
+	ReportToken string
+}
+
+// CanaryStatusResponse is the score response of ISD for a canary
+type CanaryStatusResponse struct {
+	Id           json.Number        `json:"id,omitempty"`
+	Application  string             `json:"application,omitempty"`
+	Status       CanaryResultStatus `json:"status"`
+	CanaryResult CanaryResult       `json:"canaryResult"`
+	Services     []ServiceResult    `json:"services,omitempty"`
+}
+
+// Statuses of a canary in ISD
+const (
+	canaryStatusRunning   = "RUNNING"
+	canaryStatusCompleted = "COMPLETED"
+	canaryStatusCancelled = "CANCELLED"
+	canaryStatusFailed    = "FAILED"
+	canaryStatusError     = "ERROR"
+)
+
+// Error of a canary that ISD could not analyse or whose status is not known, nil for the other statuses
+func (s CanaryStatusResponse) statusError(canaryId string) error {
+	switch s.Status.Status {
+	case canaryStatusRunning, canaryStatusCompleted, canaryStatusCancelled:
+		return nil
+	case canaryStatusFailed, canaryStatusError:
+		errorMsg := fmt.Sprintf("analysis Error: canary ID %s ended with status %s in ISD", canaryId, s.Status.Status)
+		if s.CanaryResult.Message != "" {
+			errorMsg = fmt.Sprintf("%s\nMessage: %s", errorMsg, s.CanaryResult.Message)
+		}
+		return errors.New(errorMsg)
+	}
+	response, _ := json.Marshal(s)
+	errorMsg := fmt.Sprintf("analysis Error: unknown status %q of canary ID %s in ISD\nResponse: %s", s.Status.Status, canaryId, truncateBody(response))
+	return errors.New(errorMsg)
+}
+
+type TemplateRequest struct {
+	Name string
+	Type string
+	Sha1 string
+	Data []byte
+}
+
+// SaveTemplateResponse keeps the loosely typed fields as ISD returns either strings or lists in them
+type SaveTemplateResponse struct {
+	Status       interface{} `json:"status"`
+	Error        interface{} `json:"error"`
+	ErrorMessage interface{} `json:"errorMessage"`
+}
+
+func (s SaveTemplateResponse) created() bool {
+	return s.Status == "CREATED"
+}
+
+// Error message of a template that was not saved
+func (s SaveTemplateResponse) errorMessage() string {
+	var message string
+	if s.ErrorMessage != nil && s.ErrorMessage != "" {
+		message = fmt.Sprintf("%v", s.ErrorMessage)
+	} else {
+		message = fmt.Sprintf("%v", s.Error)
+	}
+	return strings.Replace(strings.Replace(message, "[", "", -1), "]", "", -1)
+}
+
+type CancelCanaryRequest struct {
+	CanaryId string
+}
+
+const maxErrorBodyLength = 512
+
+// ISDResponseError is a non-2xx response of ISD, the body is truncated to maxErrorBodyLength
+type ISDResponseError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *ISDResponseError) Error() string {
+	message := fmt.Sprintf("analysis Error: %s %s returned %s", e.Method, e.Path, e.Status)
+	if e.Body != "" {
+		message = fmt.Sprintf("%s: %s", message, e.Body)
+	}
+	return message
+}
+
+// ISD asks to try again later with 429, 502, 503 and 504
+func (e *ISDResponseError) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Body of a response as put in an error message
+func truncateBody(body []byte) string {
+	text := strings.TrimSpace(string(body))
+	if len(text) > maxErrorBodyLength {
+		text = text[:maxErrorBodyLength] + "..."
+	}
+	return text
+}
+
+// Return an ISDResponseError for a non-2xx response
+func checkResponse(req *http.Request, res *http.Response, body []byte) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	return &ISDResponseError{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Body:       truncateBody(body),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+type isdClient struct {
+	client  http.Client
+	baseUrl string
+	user    string
+	auth    isdAuth
+	retry   RetryPolicy
+}
+
+func newISDClient(client http.Client, secretData map[string]string, retry RetryPolicy) ISDClient {
+	return &isdClient{
+		client:  client,
+		baseUrl: secretData["opsmxIsdUrl"],
+		user:    secretData["user"],
+		auth:    newISDAuth(secretData),
+		retry:   retry,
+	}
+}
+
+// Return the ISD client set on the clients, or one talking to the ISD of the secret
+func (c *Clients) isdClient(secretData map[string]string, retry RetryPolicy) ISDClient {
+	if c.isd != nil {
+		return c.isd
+	}
+	return newISDClient(c.client, secretData, retry)
+}
+
+func (i *isdClient) do(ctx context.Context, method string, url string, body []byte, header map[string]string) ([]byte, http.Header, error) {
+	var data []byte
+	var resHeader http.Header
+	err := i.retry.doIf(ctx, method+" "+url, retryableFor(method), func() error {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-spinnaker-user", i.user)
+		req.Header.Set("Content-Type", "application/json")
+		i.auth.apply(req)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		res, err := i.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		data, err = io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		resHeader = res.Header
+		return checkResponse(req, res, data)
+	})
+	//the body of an error response is returned along with the ISDResponseError
+	return data, resHeader, err
+}
+
+func (i *isdClient) RegisterCanary(ctx context.Context, req RegisterCanaryRequest) (RegisterCanaryResponse, error) {
+	canaryUrl, err := url.JoinPath(i.baseUrl, v5configIdLookupURLFormat)
+	if err != nil {
+		return RegisterCanaryResponse{}, err
+	}
+	data, header, err := i.do(ctx, "POST", canaryUrl, []byte(req.Payload), nil)
+	if err != nil {
+		return RegisterCanaryResponse{}, err
+	}
+	var canary RegisterCanaryResponse
+	if err := json.Unmarshal(data, &canary); err != nil {
+		return RegisterCanaryResponse{}, err
+	}
+	canary.ScoreUrl = header.Get("Location")
+	canary.ReportToken = header.Get("x-opsmx-report-token")
+	return canary, nil
+}
+
+func (i *isdClient) GetCanaryStatus(ctx context.Context, req CanaryStatusRequest) (CanaryStatusResponse, error) {
+	scoreUrl := req.ScoreUrl
+	if scoreUrl == "" {
+		var err error
+		scoreUrl, err = url.JoinPath(i.baseUrl, scoreUrlFormat, req.CanaryId)
+		if err != nil {
+			return CanaryStatusResponse{}, err
+		}
+	}
+	header := map[string]string{}
+	if req.ReportToken != "" {
+		header["x-opsmx-report-token"] = req.ReportToken
+	}
+	data, _, err := i.do(ctx, "GET", scoreUrl, nil, header)
+	if err != nil {
+		return CanaryStatusResponse{}, err
+	}
+	var status CanaryStatusResponse
+	if err := json.Unmarshal(data, &status); err != nil {
+		errorMessage := fmt.Sprintf("analysis Error: Error in post processing canary Response: %v", err)
+		return CanaryStatusResponse{}, errors.New(errorMessage)
+	}
+	return status, nil
+}
+
+func (i *isdClient) templateUrl(req TemplateRequest) string {
+	return i.baseUrl + fmt.Sprintf(templateApi, req.Sha1, req.Type, req.Name)
+}
+
+func (i *isdClient) VerifyTemplate(ctx context.Context, req TemplateRequest) (bool, error) {
+	data, _, err := i.do(ctx, "GET", i.templateUrl(req), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	var templateVerification bool
+	if err := json.Unmarshal(data, &templateVerification); err != nil {
+		errorMessage := fmt.Sprintf("analysis Error: Expected bool response from gitops verifyTemplate response  Error: %v. Action: Check endpoint given in secret/providerConfig.", err)
+		return false, errors.New(errorMessage)
+	}
+	return templateVerification, nil
+}
+
+func (i *isdClient) SaveTemplate(ctx context.Context, req TemplateRequest) (SaveTemplateResponse, error) {
+	data, _, err := i.do(ctx, "POST", i.templateUrl(req), req.Data, nil)
+	var responseErr *ISDResponseError
+	if err != nil && !errors.As(err, &responseErr) {
+		return SaveTemplateResponse{}, err
+	}
+	var saved SaveTemplateResponse
+	if jsonErr := json.Unmarshal(data, &saved); jsonErr != nil {
+		if err != nil {
+			return SaveTemplateResponse{}, err
+		}
+		return SaveTemplateResponse{}, jsonErr
+	}
+	//the validation errors of a template come with an error status, report them like the other template errors
+	if err != nil && saved.Error == nil && saved.ErrorMessage == nil {
+		return SaveTemplateResponse{}, err
+	}
+	return saved, nil
+}
+
+func (i *isdClient) CancelCanary(ctx context.Context, req CancelCanaryRequest) error {
+	cancelUrl, err := url.JoinPath(i.baseUrl, fmt.Sprintf(cancelCanaryUrlFormat, req.CanaryId))
+	if err != nil {
+		return err
+	}
+	_, _, err = i.do(ctx, "POST", cancelUrl, nil, nil)
+	return err
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 
 	"net/url"
+	"strings"
 
 	"fmt"
 
@@ -13,28 +13,31 @@ import (
 	"errors"
 
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 )
 
 const (
 	templateApi                             = "/autopilot/api/v5/external/template?sha1=%s&templateType=%s&templateName=%s"
 	v5configIdLookupURLFormat               = `/autopilot/api/v5/registerCanary`
 	scoreUrlFormat                          = `/autopilot/v5/canaries/`
+	cancelCanaryUrlFormat                   = `/autopilot/api/v5/canaries/%s/cancel`
 	resumeAfter                             = 3 * time.Second
 	httpConnectionTimeout     time.Duration = 15 * time.Second
 	defaultSecretName                       = "opsmx-profile"
 	cdIntegrationArgoRollouts               = "argorollouts"
 	cdIntegrationArgoCD                     = "argocd"
+	defaultBasePath                         = "/etc/config/"
 )
 
-func runAnalysis(c *Clients, r ResourceNames, basePath string) (ExitCode, error) {
+func runAnalysis(ctx context.Context, c *Clients, r ResourceNames, paths ConfigPaths) (ExitCode, error) {
 	log.Info("starting the getAnalysisTemplateData function")
-	metric, err := getAnalysisTemplateData(basePath)
+	metric, err := getAnalysisTemplateData(paths.providerConfig)
 	if err != nil {
 		return ReturnCodeError, err
 	}
 
 	if metric.Application == "" {
-		metric.Application, err = getProviderConfigNameFromJob(c, r)
+		metric.Application, err = getProviderConfigNameFromJob(ctx, c, r)
 		if err != nil {
 			return ReturnCodeError, err
 		}
@@ -49,165 +52,312 @@ func runAnalysis(c *Clients, r ResourceNames, basePath string) (ExitCode, error)
 	}
 	log.Info("basic checks completed successfully")
 	log.Info("getting the data from the secret")
-	secretData, err := metric.getDataSecret(basePath)
+	secretData, err := metric.getDataSecret(paths.secrets)
 	if err != nil {
 		return ReturnCodeError, err
 	}
 	log.Info("secret data retrieved successfully")
-	if err := metric.checkISDUrl(c, secretData["opsmxIsdUrl"]); err != nil {
+	if err := c.configureTLS(paths.secrets); err != nil {
 		return ReturnCodeError, err
 	}
-	//Get the epochs for Time variables and the lifetimeMinutes
-	err = metric.getTimeVariables()
-	if err != nil {
+	if err := metric.checkISDUrl(ctx, c, secretData); err != nil {
 		return ReturnCodeError, err
 	}
-	log.Info("generating the payload")
-	canaryurl, err := url.JoinPath(secretData["opsmxIsdUrl"], v5configIdLookupURLFormat)
-	if err != nil {
-		return ReturnCodeError, err
+	c.recordEvent(ctx, CanaryDetails{jobName: r.jobName}, corev1.EventTypeNormal, EventReasonConfigValidated, "provider config and opsmx profile secret validated")
+	//a previous pod of the Job may already have registered the canary before being evicted
+	previous := getRegisteredCanary(ctx, c, r)
+	//the window of a resumed canary started when the previous pod registered it, not when this pod started
+	if metric.CanaryStartTime == "" && !previous.registeredAt.IsZero() {
+		metric.CanaryStartTime = previous.registeredAt.UTC().Format(time.RFC3339)
 	}
-	payload, err := metric.generatePayload(c, secretData, basePath)
-	if err != nil {
-		return ReturnCodeError, err
-	}
-	log.Info(payload)
-	log.Info("sending a POST request to registerCanary with the payload")
-	data, scoreURL, urlToken, err := makeRequest(c.client, "POST", canaryurl, payload, secretData["user"])
+	//Get the epochs for Time variables and the lifetimeMinutes
+	err = metric.getTimeVariables()
 	if err != nil {
 		return ReturnCodeError, err
 	}
-	//Struct to record canary Response
-	type canaryResponse struct {
-		Error    string      `json:"error,omitempty"`
-		Message  string      `json:"message,omitempty"`
-		CanaryId json.Number `json:"canaryId,omitempty"`
-	}
-	var canary canaryResponse
-
-	err = json.Unmarshal(data, &canary)
-	if err != nil {
-		return ReturnCodeError, err
+	//bound the rest of the run by the analysis window, ISD may keep reporting RUNNING
+	deadline := metric.analysisDeadline()
+	log.Infof("the analysis has to finish by %s", deadline.Format(time.RFC3339))
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	cd := CanaryDetails{
+		user:    secretData["user"],
+		jobName: r.jobName,
 	}
-	log.Info("register canary response ", canary)
-	if canary.Error != "" {
-		errMessage := fmt.Sprintf("analysis Error: %s\nMessage: %s", canary.Error, canary.Message)
-		err := errors.New(errMessage)
+	var canaryId, scoreURL, urlToken string
+	if previous.canaryId != "" {
+		log.Infof("resuming the analysis of canary ID %s registered by a previous pod of the Job", previous.canaryId)
+		canaryId = previous.canaryId
+		urlToken = previous.ReportId
+		cd.registeredAt = previous.registeredAt
+		cd.canaryId = canaryId
+		cd.ReportId = urlToken
+		scoreURL, err = url.JoinPath(secretData["opsmxIsdUrl"], scoreUrlFormat, canaryId)
 		if err != nil {
 			return ReturnCodeError, err
 		}
+	} else {
+		//do not register a canary if the job was asked to stop in the meantime
+		if ctx.Err() != nil {
+			log.Info("termination requested before registering the canary")
+			return metric.stopAnalysis(ctx, c, secretData, cd)
+		}
+		canaryId, scoreURL, urlToken, err = metric.registerCanary(ctx, c, secretData, paths.templates)
+		cd.registeredAt = time.Now()
+		//a canary registered while the job was asked to stop still has to be cancelled in ISD
+		cd.canaryId = canaryId
+		cd.ReportId = urlToken
+		if ctx.Err() != nil {
+			return metric.stopAnalysis(ctx, c, secretData, cd)
+		}
+		if err != nil {
+			return ReturnCodeError, err
+		}
+		if metric.GitOPS {
+			c.recordEvent(ctx, cd, corev1.EventTypeNormal, EventReasonTemplatesSynced, "gitops templates synced to ISD")
+		}
 	}
-	if scoreURL == "" {
-		return ReturnCodeError, errors.New("analysis Error: score url not found")
-	}
-	data, _, _, err = makeRequest(c.client, "GET", scoreURL, "", secretData["user"])
-	if err != nil {
-		return ReturnCodeError, err
+	isd := c.isdClient(secretData, metric.Retry)
+	statusRequest := CanaryStatusRequest{
+		CanaryId:    canaryId,
+		ScoreUrl:    scoreURL,
+		ReportToken: urlToken,
 	}
-
-	var status map[string]interface{}
-	var reportUrlJson map[string]interface{}
-
-	err = json.Unmarshal(data, &status)
-	if err != nil {
-		errorMessage := fmt.Sprintf("analysis Error: Error in post processing canary Response: %v", err)
-		return ReturnCodeError, errors.New(errorMessage)
+	status, err := isd.GetCanaryStatus(ctx, statusRequest)
+	if ctx.Err() != nil {
+		return metric.stopAnalysis(ctx, c, secretData, cd)
 	}
-	jsonBytes, _ := json.MarshalIndent(status["canaryResult"], "", "   ")
-	err = json.Unmarshal(jsonBytes, &reportUrlJson)
 	if err != nil {
 		return ReturnCodeError, err
 	}
-	reportUrl := reportUrlJson["canaryReportURL"]
-
-	ctx := context.TODO()
-
-	cd := CanaryDetails{
-		user:      secretData["user"],
-		jobName:   r.jobName,
-		canaryId:  canary.CanaryId.String(),
-		reportUrl: fmt.Sprintf("%s", reportUrl),
-		ReportId:  urlToken,
+	reportUrl := status.CanaryResult.CanaryReportURL
+	cd.reportUrl = reportUrl
+	if previous.canaryId != "" {
+		c.recordEvent(ctx, cd, corev1.EventTypeNormal, EventReasonCanaryResumed, "canary registered by a previous pod of the Job resumed")
+	} else {
+		c.recordEvent(ctx, cd, corev1.EventTypeNormal, EventReasonCanaryRegistered, "canary registered in ISD")
 	}
+
 	log.Info("starting the patching operation of the canary details to the Job")
 	err = patchJobCanaryDetails(ctx, c.kubeclientset, cd)
+	if ctx.Err() != nil {
+		return metric.stopAnalysis(ctx, c, secretData, cd)
+	}
 	if err != nil {
 		return ReturnCodeError, err
 	}
+	c.annotateOwners(ctx, cd)
 
-	retryScorePool := 5
-	process := "RUNNING"
-	//if the status is Running, pool again after delay
-	for process == "RUNNING" {
-		err = json.Unmarshal(data, &status)
+	//if the status is Running, pool again after the poll interval, transient failures are retried by the ISD client
+	wait := metric.Poll.firstWait(metric.firstScoreAt())
+	var intervalNo string
+	for polls := 0; status.Status.Status == canaryStatusRunning; polls++ {
+		if polls > 0 {
+			wait = metric.Poll.wait(polls - 1)
+		}
+		log.Infof("canary ID %s is running, polling again in %v", canaryId, wait)
+		select {
+		case <-ctx.Done():
+			return metric.stopAnalysis(ctx, c, secretData, cd)
+		case <-time.After(wait):
+		}
+		status, err = isd.GetCanaryStatus(ctx, statusRequest)
+		if ctx.Err() != nil {
+			return metric.stopAnalysis(ctx, c, secretData, cd)
+		}
 		if err != nil {
-			errorMessage := fmt.Sprintf("analysis Error: Error in post processing canary Response: %v", err)
+			errorMessage := fmt.Sprintf("analysis Error: Error in getting canary Response: %v", err)
 			return ReturnCodeError, errors.New(errorMessage)
 		}
-		a, _ := json.MarshalIndent(status["status"], "", "   ")
-		err = json.Unmarshal(a, &status)
-		if err != nil {
-			return ReturnCodeError, err
+		if status.Status.Status != canaryStatusRunning {
+			continue
 		}
-
-		if status["status"] != "RUNNING" {
-			process = "COMPLETED"
-		} else {
-			time.Sleep(resumeAfter)
-			data, _, _, err = makeRequest(c.client, "GET", scoreURL, "", secretData["user"])
-			if err != nil && retryScorePool == 0 {
-				errorMessage := fmt.Sprintf("analysis Error: Error in getting canary Response: %v", err)
-				return ReturnCodeError, errors.New(errorMessage)
-			} else {
-				retryScorePool -= 1
-			}
+		var score int
+		var scored bool
+		if intervalNo, score, scored = status.newIntervalScore(intervalNo); !scored {
+			continue
+		}
+		patchIntervalScore(ctx, c, cd, intervalNo, score)
+		if metric.AbortBelow != 0 && score < metric.AbortBelow {
+			return metric.abortAnalysis(ctx, c, secretData, cd, intervalNo, score)
 		}
 	}
-	//if run is cancelled mid-run
-	if status["status"] == "CANCELLED" {
+	switch status.Status.Status {
+	case canaryStatusCompleted:
+	case canaryStatusCancelled:
+		//if run is cancelled mid-run
 		log.Info("starting the patching operation for a CANCELLED operation")
+		c.recordEvent(ctx, cd, corev1.EventTypeWarning, EventReasonAnalysisCancelled, "canary cancelled in ISD")
 		err = patchJobCancelled(ctx, c.kubeclientset, r.jobName)
 		if err != nil {
 			return ReturnCodeError, err
 		}
 		return ReturnCodeCancelled, nil
+	default:
+		//ISD could not analyse the canary, or answered with a status that is not known
+		return ReturnCodeError, status.statusError(canaryId)
 	}
-	log.Info("final response ", string(data))
+	log.Infof("final result of canary ID %s: %s, score %s", canaryId, status.CanaryResult.OverallResult, status.CanaryResult.OverallScore)
 	//POST-Run process
-	Phase, Score, err := metric.processResume(data)
+	Phase, Score, err := metric.processResume(status.CanaryResult)
+	if err != nil {
+		return ReturnCodeError, err
+	}
+	//a service with its own passScore fails the analysis whatever the overall score
+	reason := Phase
+	failedGates, err := metric.failedGates(status.Services)
 	if err != nil {
 		return ReturnCodeError, err
 	}
+	if len(failedGates) != 0 {
+		Phase = AnalysisPhaseFailed
+		reason = fmt.Sprintf("%s, %s", AnalysisPhaseFailed, strings.Join(failedGates, ", "))
+	}
+	cd.value = Score
+	cd.phase = Phase
+	cd.services = status.Services
+	c.annotateOwners(ctx, cd)
 	if Phase == AnalysisPhaseSuccessful {
-		fs := CanaryDetails{
-			user:      secretData["user"],
-			jobName:   r.jobName,
-			canaryId:  canary.CanaryId.String(),
-			reportUrl: fmt.Sprintf("%s", reportUrl),
-			value:     Score,
-			ReportId:  urlToken,
-		}
 		log.Infof("starting the patching operation for a %s operation", AnalysisPhaseSuccessful)
-		err = patchJobSuccessful(ctx, c.kubeclientset, fs)
+		c.recordAnalysisCompleted(ctx, cd, "")
+		err = patchJobSuccessful(ctx, c.kubeclientset, cd)
 		if err != nil {
 			return ReturnCodeError, err
 		}
 	}
 	if Phase == AnalysisPhaseFailed {
-		fs := CanaryDetails{
-			user:      secretData["user"],
-			jobName:   r.jobName,
-			canaryId:  canary.CanaryId.String(),
-			reportUrl: fmt.Sprintf("%s", reportUrl),
-			value:     Score,
-			ReportId:  urlToken,
-		}
 		log.Infof("starting the patching operation for a %s operation", AnalysisPhaseFailed)
-		err = patchJobFailedInconclusive(ctx, c.kubeclientset, Phase, fs)
+		c.recordAnalysisCompleted(ctx, cd, strings.Join(failedGates, ", "))
+		err = patchJobFailedInconclusive(ctx, c.kubeclientset, reason, cd)
 		if err != nil {
 			return ReturnCodeError, err
 		}
 		return ReturnCodeFailed, nil
 	}
+	if Phase == AnalysisPhaseInconclusive {
+		log.Infof("starting the patching operation for a %s operation", AnalysisPhaseInconclusive)
+		c.recordAnalysisCompleted(ctx, cd, "")
+		err = patchJobFailedInconclusive(ctx, c.kubeclientset, Phase, cd)
+		if err != nil {
+			return ReturnCodeError, err
+		}
+		return ReturnCodeInconclusive, nil
+	}
 	return ReturnCodeSuccess, nil
 }
+
+// Patch the score of an interval onto the Job as soon as ISD has scored it
+func patchIntervalScore(ctx context.Context, c *Clients, cd CanaryDetails, intervalNo string, score int) {
+	cd.value = fmt.Sprintf("%d", score)
+	log.Infof("interval %s of canary ID %s scored %s", intervalNo, cd.canaryId, cd.value)
+	c.recordEvent(ctx, cd, corev1.EventTypeNormal, EventReasonIntervalScored, fmt.Sprintf("interval %s scored %s", intervalNo, cd.value))
+	//the interval scores only show the progress, the analysis goes on when they cannot be patched
+	if err := patchJobIntervalScore(ctx, c.kubeclientset, cd, intervalNo); err != nil {
+		log.Warnf("could not patch the score of interval %s to the Job: %v", intervalNo, err)
+	}
+}
+
+// Cancel the canary in ISD and fail the analysis once an interval has scored below abortBelowScore
+func (metric *OPSMXMetric) abortAnalysis(ctx context.Context, c *Clients, secretData map[string]string, cd CanaryDetails, intervalNo string, score int) (ExitCode, error) {
+	log.Infof("interval %s scored %d below abortBelowScore %d, cancelling canary ID %s in ISD", intervalNo, score, metric.AbortBelow, cd.canaryId)
+	if err := metric.cancelCanary(ctx, c, secretData, cd.canaryId); err != nil {
+		log.Errorf("could not cancel canary ID %s in ISD: %v", cd.canaryId, err)
+	}
+	cd.value = fmt.Sprintf("%d", score)
+	cd.phase = AnalysisPhaseFailed
+	c.annotateOwners(ctx, cd)
+	reason := fmt.Sprintf("aborted early, interval %s scored %d below abortBelowScore %d", intervalNo, score, metric.AbortBelow)
+	c.recordAnalysisCompleted(ctx, cd, reason)
+	log.Info("starting the patching operation for an aborted operation")
+	err := patchJobFailedInconclusive(ctx, c.kubeclientset, reason, cd)
+	if err != nil {
+		return ReturnCodeError, err
+	}
+	return ReturnCodeFailed, nil
+}
+
+// Context of the calls made once the run context is done, bounded like a single http call
+func finalContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), httpConnectionTimeout)
+}
+
+// End a run whose context is done, either the job has been asked to stop or the deadline has passed
+func (metric *OPSMXMetric) stopAnalysis(ctx context.Context, c *Clients, secretData map[string]string, cd CanaryDetails) (ExitCode, error) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return metric.deadlineExceeded(c, secretData, cd)
+	}
+	return metric.cancelAnalysis(c, secretData, cd)
+}
+
+// Cancel the registered canary in ISD and mark the Job as Cancelled once the job has been asked to stop
+func (metric *OPSMXMetric) cancelAnalysis(c *Clients, secretData map[string]string, cd CanaryDetails) (ExitCode, error) {
+	//the run context is already cancelled, continue with a fresh one
+	ctx, cancel := finalContext()
+	defer cancel()
+	if cd.canaryId != "" {
+		log.Infof("termination requested, cancelling canary ID %s in ISD", cd.canaryId)
+		if err := metric.cancelCanary(ctx, c, secretData, cd.canaryId); err != nil {
+			log.Errorf("could not cancel canary ID %s in ISD: %v", cd.canaryId, err)
+		}
+	}
+	c.recordEvent(ctx, cd, corev1.EventTypeWarning, EventReasonAnalysisCancelled, "termination requested, the analysis has been stopped")
+	log.Info("starting the patching operation for a CANCELLED operation")
+	err := patchJobCancelled(ctx, c.kubeclientset, cd.jobName)
+	if err != nil {
+		return ReturnCodeError, err
+	}
+	return ReturnCodeCancelled, nil
+}
+
+// Cancel the canary still running in ISD once the deadline has passed and end the analysis as set in the deadline policy
+func (metric *OPSMXMetric) deadlineExceeded(c *Clients, secretData map[string]string, cd CanaryDetails) (ExitCode, error) {
+	policy := metric.Deadline.withDefaults()
+	ctx, cancel := finalContext()
+	defer cancel()
+	if cd.canaryId != "" {
+		log.Infof("deadline of the analysis has passed, cancelling canary ID %s in ISD", cd.canaryId)
+		if err := metric.cancelCanary(ctx, c, secretData, cd.canaryId); err != nil {
+			log.Errorf("could not cancel canary ID %s in ISD: %v", cd.canaryId, err)
+		}
+	}
+	if policy.OnTimeout == deadlinePolicyError {
+		return ReturnCodeError, fmt.Errorf("analysis Error: %w, lifetimeMinutes %d, delay %d and gracePeriod %v have passed", errAnalysisDeadlineExceeded, metric.LifetimeMinutes, metric.Delay, policy.GracePeriod)
+	}
+	log.Infof("starting the patching operation for a %s operation", deadlinePolicyInconclusive)
+	cd.phase = AnalysisPhaseInconclusive
+	c.recordAnalysisCompleted(ctx, cd, "exceeded its deadline")
+	err := patchJobFailedInconclusive(ctx, c.kubeclientset, "exceeded its deadline", cd)
+	if err != nil {
+		return ReturnCodeError, err
+	}
+	return ReturnCodeInconclusive, nil
+}
+
+// Ask ISD to stop analysing a registered canary
+func (metric *OPSMXMetric) cancelCanary(ctx context.Context, c *Clients, secretData map[string]string, canaryId string) error {
+	return c.isdClient(secretData, metric.Retry).CancelCanary(ctx, CancelCanaryRequest{CanaryId: canaryId})
+}
+
+// Send the payload to registerCanary and return the canary ID, the score url and the report token
+func (metric *OPSMXMetric) registerCanary(ctx context.Context, c *Clients, secretData map[string]string, templatesPath string) (string, string, string, error) {
+	log.Info("generating the payload")
+	payload, err := metric.generatePayload(ctx, c, secretData, templatesPath)
+	if err != nil {
+		return "", "", "", err
+	}
+	log.Info(payload)
+	log.Info("sending a POST request to registerCanary with the payload")
+	canary, err := c.isdClient(secretData, metric.Retry).RegisterCanary(ctx, RegisterCanaryRequest{Payload: payload})
+	if err != nil {
+		return "", "", "", err
+	}
+	log.Info("register canary response ", canary)
+	if canary.Error != "" {
+		errMessage := fmt.Sprintf("analysis Error: %s\nMessage: %s", canary.Error, canary.Message)
+		return "", "", "", errors.New(errMessage)
+	}
+	if canary.ScoreUrl == "" {
+		return "", "", "", errors.New("analysis Error: score url not found")
+	}
+	return canary.CanaryId.String(), canary.ScoreUrl, canary.ReportToken, nil
+}
@@ -2,19 +2,42 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	argofake "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned/fake"
+	"github.com/argoproj/argo-rollouts/utils/defaults"
+	"github.com/opsmx/argo-metricprovider-job/analysis"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
 )
@@ -64,7 +87,7 @@ func TestFuncGetAnalysisTemplateData(t *testing.T) {
 	emptyFile.Close()
 	input, _ := os.ReadFile("testcases/analysis/providerConfig")
 	_ = os.WriteFile("testcases/provider/providerConfig", input, 0644)
-	metric, err := getAnalysisTemplateData("testcases/")
+	metric, err := getAnalysisTemplateData("testcases/provider/providerConfig")
 	checkMetric := OPSMXMetric{
 		Application:     "final-job",
 		User:            "admin",
@@ -88,11 +111,11 @@ func TestFuncGetAnalysisTemplateData(t *testing.T) {
 	checkMetric.Services = append(checkMetric.Services, services)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, metric, checkMetric)
-	_, err = getAnalysisTemplateData("/etc/config/")
+	_, err = getAnalysisTemplateData("/etc/config/provider/providerConfig")
 	assert.Equal(t, err.Error(), "provider config map validation error: open /etc/config/provider/providerConfig: no such file or directory\n Action Required: Provider config map has to be mounted on '/etc/config/provider' in AnalysisTemplate and must carry data element 'providerConfig'")
 	input, _ = os.ReadFile("testcases/analysis/invalid")
 	_ = os.WriteFile("testcases/provider/providerConfig", input, 0644)
-	_, err = getAnalysisTemplateData("testcases/")
+	_, err = getAnalysisTemplateData("testcases/provider/providerConfig")
 	assert.Equal(t, err.Error(), "provider config map validation error: yaml: line 8: mapping values are not allowed in this context")
 	if _, err := os.Stat("testcases/provider"); !os.IsNotExist(err) {
 		os.RemoveAll("testcases/provider")
@@ -386,36 +409,36 @@ func TestSecret(t *testing.T) {
 		CanaryMetricScope:    "argocd,{{env.LATEST_POD_HASH}},demoapp-issuegen",
 	}
 	metric.Services = append(metric.Services, services)
-	_, err := metric.getDataSecret("testcases/")
-	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/user: no such file or directory\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'user'")
+	_, err := metric.getDataSecret("testcases/secrets")
+	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/user: no such file or directory\n Action Required: secret file has to be mounted on 'testcases/secrets' in AnalysisTemplate and must carry data element 'user'")
 	_ = os.MkdirAll("testcases/secrets", os.ModePerm)
 	emptyFile, _ := os.Create("testcases/secrets/user")
 	emptyFile.Close()
 	input, _ := os.ReadFile("testcases/secret/user")
 	_ = os.WriteFile("testcases/secrets/user", input, 0644)
 
-	_, err = metric.getDataSecret("testcases/")
-	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/opsmxIsdUrl: no such file or directory\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'opsmxIsdUrl'")
+	_, err = metric.getDataSecret("testcases/secrets")
+	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/opsmxIsdUrl: no such file or directory\n Action Required: secret file has to be mounted on 'testcases/secrets' in AnalysisTemplate and must carry data element 'opsmxIsdUrl'")
 	emptyFile, _ = os.Create("testcases/secrets/opsmxIsdUrl")
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/secret/gate-url")
 	_ = os.WriteFile("testcases/secrets/opsmxIsdUrl", input, 0644)
 
-	_, err = metric.getDataSecret("testcases/")
-	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/sourceName: no such file or directory\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'sourceName'")
+	_, err = metric.getDataSecret("testcases/secrets")
+	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/sourceName: no such file or directory\n Action Required: secret file has to be mounted on 'testcases/secrets' in AnalysisTemplate and must carry data element 'sourceName'")
 	emptyFile, _ = os.Create("testcases/secrets/sourceName")
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/secret/source-name")
 	_ = os.WriteFile("testcases/secrets/sourceName", input, 0644)
 
-	_, err = metric.getDataSecret("testcases/")
-	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/cdIntegration: no such file or directory\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'cdIntegration'")
+	_, err = metric.getDataSecret("testcases/secrets")
+	assert.Equal(t, err.Error(), "opsmx profile secret validation error: open testcases/secrets/cdIntegration: no such file or directory\n Action Required: secret file has to be mounted on 'testcases/secrets' in AnalysisTemplate and must carry data element 'cdIntegration'")
 	emptyFile, _ = os.Create("testcases/secrets/cdIntegration")
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/secret/cd-Integration")
 	_ = os.WriteFile("testcases/secrets/cdIntegration", input, 0644)
 
-	secretData, err := metric.getDataSecret("testcases/")
+	secretData, err := metric.getDataSecret("testcases/secrets")
 	assert.Equal(t, nil, err)
 	checkSecretData := map[string]string{
 		"cdIntegration": "argocd",
@@ -427,7 +450,7 @@ func TestSecret(t *testing.T) {
 
 	input, _ = os.ReadFile("testcases/secret/cd-Integration-False")
 	_ = os.WriteFile("testcases/secrets/cdIntegration", input, 0644)
-	secretData, err = metric.getDataSecret("testcases/")
+	secretData, err = metric.getDataSecret("testcases/secrets")
 	assert.Equal(t, err, nil)
 	checkSecretData = map[string]string{
 		"cdIntegration": "argorollouts",
@@ -439,7 +462,7 @@ func TestSecret(t *testing.T) {
 
 	input, _ = os.ReadFile("testcases/secret/cd-Integration-Invalid")
 	_ = os.WriteFile("testcases/secrets/cdIntegration", input, 0644)
-	_, err = metric.getDataSecret("testcases/")
+	_, err = metric.getDataSecret("testcases/secrets")
 	assert.Equal(t, err.Error(), "opsmx profile secret validation error: cdIntegration should be either true or false")
 	if _, err := os.Stat("testcases/secrets"); !os.IsNotExist(err) {
 		os.RemoveAll("testcases/secrets")
@@ -1512,7 +1535,7 @@ func TestPayload(t *testing.T) {
 	for _, test := range successfulPayload {
 		err := test.metric.getTimeVariables()
 		assert.Equal(t, nil, err)
-		payload, err := test.metric.generatePayload(clients, SecretData, "notrequired")
+		payload, err := test.metric.generatePayload(context.TODO(), clients, SecretData, "notrequired")
 		assert.Equal(t, nil, err)
 		processedPayload := strings.Replace(strings.Replace(strings.Replace(test.payloadRegisterCanary, "\n", "", -1), "\t", "", -1), " ", "", -1)
 		assert.Equal(t, processedPayload, payload)
@@ -1520,7 +1543,7 @@ func TestPayload(t *testing.T) {
 	for _, test := range failPayload {
 		err := test.metric.getTimeVariables()
 		assert.Equal(t, nil, err)
-		_, err = test.metric.generatePayload(clients, SecretData, "notrequired")
+		_, err = test.metric.generatePayload(context.TODO(), clients, SecretData, "notrequired")
 		assert.Equal(t, test.message, err.Error())
 	}
 	metric := OPSMXMetric{
@@ -1549,16 +1572,16 @@ func TestPayload(t *testing.T) {
 	metric.Services = append(metric.Services, services)
 	err := metric.getTimeVariables()
 	assert.Equal(t, nil, err)
-	_, err = metric.generatePayload(clients, SecretData, "notRequired")
+	_, err = metric.generatePayload(context.TODO(), clients, SecretData, "notRequired")
 	assert.Equal(t, "analysisTemplate validation error: environment variable STABLE_POD_HASH not set", err.Error())
 	os.Setenv("STABLE_POD_HASH", "baseline")
-	_, err = metric.generatePayload(clients, SecretData, "notRequired")
+	_, err = metric.generatePayload(context.TODO(), clients, SecretData, "notRequired")
 	assert.Equal(t, "analysisTemplate validation error: environment variable LATEST_POD_HASH not set", err.Error())
 	os.Setenv("LATEST_POD_HASH", "baseline")
-	_, err = metric.generatePayload(clients, SecretData, "notRequired")
+	_, err = metric.generatePayload(context.TODO(), clients, SecretData, "notRequired")
 	assert.Equal(t, "analysisTemplate validation error: environment variable STABLE_POD_METRIC_HASH not set", err.Error())
 	os.Setenv("STABLE_POD_METRIC_HASH", "baseline")
-	_, err = metric.generatePayload(clients, SecretData, "notRequired")
+	_, err = metric.generatePayload(context.TODO(), clients, SecretData, "notRequired")
 	assert.Equal(t, "analysisTemplate validation error: environment variable LATEST_POD_METRIC_HASH not set", err.Error())
 }
 
@@ -1654,15 +1677,15 @@ func TestGitops(t *testing.T) {
 	metric.Services = append(metric.Services, services)
 	err := metric.getTimeVariables()
 	assert.Equal(t, nil, err)
-	_, err = metric.generatePayload(clients, SecretData, "incorrect/")
-	assert.Equal(t, "gitops 'loggytemp' template config map validation error: open incorrect/templates/loggytemp: no such file or directory\n Action Required: Template has to be mounted on '/etc/config/templates' in AnalysisTemplate and must carry data element 'loggytemp'", err.Error())
+	_, err = metric.generatePayload(context.TODO(), clients, SecretData, "incorrect/templates")
+	assert.Equal(t, "gitops 'loggytemp' template config map validation error: open incorrect/templates/loggytemp: no such file or directory\n Action Required: Template has to be mounted on 'incorrect/templates' in AnalysisTemplate and must carry data element 'loggytemp'", err.Error())
 
 	_ = os.MkdirAll("testcases/templates", os.ModePerm)
 	emptyFile, _ := os.Create("testcases/templates/loggytemp")
 	emptyFile.Close()
 	input, _ := os.ReadFile("testcases/gitops/loggytemp")
 	_ = os.WriteFile("testcases/templates/loggytemp", input, 0644)
-	payload, err := metric.generatePayload(clients, SecretData, "testcases/")
+	payload, err := metric.generatePayload(context.TODO(), clients, SecretData, "testcases/templates")
 	assert.Equal(t, nil, err)
 	processedPayload := strings.Replace(strings.Replace(strings.Replace(checkPayload, "\n", "", -1), "\t", "", -1), " ", "", -1)
 	assert.Equal(t, processedPayload, payload)
@@ -1732,9 +1755,9 @@ func TestGitops(t *testing.T) {
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/gitops/PrometheusMetricTemplate")
 	_ = os.WriteFile("testcases/templates/PrometheusMetricTemplate", input, 0644)
-	_, err = metric.generatePayload(clients, SecretData, "gitops/nothere/")
-	assert.Equal(t, "gitops 'PrometheusMetricTemplate' template config map validation error: open gitops/nothere/templates/PrometheusMetricTemplate: no such file or directory\n Action Required: Template has to be mounted on '/etc/config/templates' in AnalysisTemplate and must carry data element 'PrometheusMetricTemplate'", err.Error())
-	payload, err = metric.generatePayload(clients, SecretData, "testcases/")
+	_, err = metric.generatePayload(context.TODO(), clients, SecretData, "gitops/nothere/templates")
+	assert.Equal(t, "gitops 'PrometheusMetricTemplate' template config map validation error: open gitops/nothere/templates/PrometheusMetricTemplate: no such file or directory\n Action Required: Template has to be mounted on 'gitops/nothere/templates' in AnalysisTemplate and must carry data element 'PrometheusMetricTemplate'", err.Error())
+	payload, err = metric.generatePayload(context.TODO(), clients, SecretData, "testcases/templates")
 	assert.Equal(t, nil, err)
 	processedPayload = strings.Replace(strings.Replace(strings.Replace(checkPayload, "\n", "", -1), "\t", "", -1), " ", "", -1)
 	assert.Equal(t, processedPayload, payload)
@@ -1791,7 +1814,7 @@ func TestGitops(t *testing.T) {
 	metric.Services = append(metric.Services, services)
 	err = metric.getTimeVariables()
 	assert.Equal(t, nil, err)
-	_, err = getTemplateData(clientFail.client, SecretData, "loggytemp", "LOG", "testcases/", "scope")
+	_, err = getTemplateData(context.TODO(), newISDClient(clientFail.client, SecretData, RetryPolicy{}), "loggytemp", "LOG", "testcases/templates", "scope")
 	assert.Equal(t, "gitops 'loggytemp' template config map validation error: ISD-EmptyKeyOrValueInJson-400-07 : Analytics Service - Name key or value is missing in json ! ISD-EmptyKeyOrValueInJson-400-07 : Analytics Service - Account name key or value is missing in json ! ISD-IsNotFound-404-01 : Analytics Service - Datasource account not found : ", err.Error())
 
 	invalidjsonmetric := OPSMXMetric{
@@ -1818,7 +1841,7 @@ func TestGitops(t *testing.T) {
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/gitops/invalid/loggytemp.txt")
 	_ = os.WriteFile("testcases/templates/invalid.txt", input, 0644)
-	_, err = invalidjsonmetric.generatePayload(clients, SecretData, "testcases/")
+	_, err = invalidjsonmetric.generatePayload(context.TODO(), clients, SecretData, "testcases/templates")
 	assert.Equal(t, "gitops 'invalid.txt' template config map validation error: yaml: line 22: did not find expected ',' or '}'", err.Error())
 
 	metric = OPSMXMetric{
@@ -1867,7 +1890,7 @@ func TestGitops(t *testing.T) {
 	metric.Services = append(metric.Services, services)
 	err = metric.getTimeVariables()
 	assert.Equal(t, nil, err)
-	_, err = getTemplateData(clientInvalid.client, SecretData, "loggytemp", "LOG", "testcases/", "scope")
+	_, err = getTemplateData(context.TODO(), newISDClient(clientInvalid.client, SecretData, RetryPolicy{}), "loggytemp", "LOG", "testcases/templates", "scope")
 	assert.Equal(t, "analysis Error: Expected bool response from gitops verifyTemplate response  Error: invalid character 'f' looking for beginning of object key string. Action: Check endpoint given in secret/providerConfig.", err.Error())
 
 	cinv = NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -1892,7 +1915,7 @@ func TestGitops(t *testing.T) {
 		}
 	})
 	clientInvalid = newClients(nil, cinv)
-	_, err = getTemplateData(clientInvalid.client, SecretData, "loggytemp", "LOG", "testcases/", "scope")
+	_, err = getTemplateData(context.TODO(), newISDClient(clientInvalid.client, SecretData, RetryPolicy{}), "loggytemp", "LOG", "testcases/templates", "scope")
 	assert.Equal(t, "invalid character '2' after object key", err.Error())
 	if _, err := os.Stat("testcases/templates"); !os.IsNotExist(err) {
 		os.RemoveAll("testcases/templates")
@@ -1953,7 +1976,7 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	phase, canaryScore, err := metric.processResume(input)
+	phase, canaryScore, err := metric.processResume(canaryStatusResponse(t, string(input)).CanaryResult)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "100", canaryScore)
 	assert.Equal(t, AnalysisPhaseSuccessful, phase)
@@ -1989,7 +2012,7 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	phase, canaryScore, err = metric.processResume(input)
+	phase, canaryScore, err = metric.processResume(canaryStatusResponse(t, string(input)).CanaryResult)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "0", canaryScore)
 	assert.Equal(t, AnalysisPhaseFailed, phase)
@@ -2024,7 +2047,7 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	phase, canaryScore, err = metric.processResume(input)
+	phase, canaryScore, err = metric.processResume(canaryStatusResponse(t, string(input)).CanaryResult)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "0", canaryScore)
 	assert.Equal(t, AnalysisPhaseFailed, phase)
@@ -2060,7 +2083,7 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	phase, canaryScore, err = metric.processResume(input)
+	phase, canaryScore, err = metric.processResume(canaryStatusResponse(t, string(input)).CanaryResult)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "97", canaryScore)
 	assert.Equal(t, AnalysisPhaseSuccessful, phase)
@@ -2096,7 +2119,7 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	_, _, err = metric.processResume(input)
+	_, _, err = metric.processResume(canaryStatusResponse(t, string(input)).CanaryResult)
 
 	assert.Equal(t, "strconv.ParseFloat: parsing \"97.2a5\": invalid syntax", err.Error())
 
@@ -2131,10 +2154,11 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	_, _, err = metric.processResume(input)
+	_, _, err = metric.processResume(canaryStatusResponse(t, string(input)).CanaryResult)
 
 	assert.Equal(t, "strconv.Atoi: parsing \"9a7\": invalid syntax", err.Error())
 
+	//a malformed response is already rejected when the status is read
 	input, _ = io.ReadAll(bytes.NewBufferString(`
 	{
 		"owner": "admin",
@@ -2166,9 +2190,16 @@ func TestProcessResume(t *testing.T) {
 			"status": "COMPLETED"
 		}}
 	`))
-	_, _, err = metric.processResume(input)
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBuffer(input)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	_, err = newISDClient(c, map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst"}, RetryPolicy{}).GetCanaryStatus(context.TODO(), CanaryStatusRequest{CanaryId: "1424"})
 
-	assert.Equal(t, "analysis Error: Error in post processing canary Response. Error: invalid character '\"' after object key:value pair", err.Error())
+	assert.Equal(t, "analysis Error: Error in post processing canary Response: invalid character '\"' after object key:value pair", err.Error())
 }
 
 func TestRunAnalysis(t *testing.T) {
@@ -2227,7 +2258,7 @@ func TestRunAnalysis(t *testing.T) {
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/analysis/providerConfig")
 	_ = os.WriteFile("testcases/provider/providerConfig", input, 0644)
-	_, err := runAnalysis(clients, resourceNames, "testcases/")
+	_, err := runAnalysis(context.TODO(), clients, resourceNames, newConfigPaths("testcases/"))
 	assert.Equal(t, nil, err)
 
 	cInv := NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -2243,7 +2274,7 @@ func TestRunAnalysis(t *testing.T) {
 		}, nil
 	})
 	clientsInv := newClients(k8sclient, cInv)
-	_, err = runAnalysis(clientsInv, resourceNames, "testcases/")
+	_, err = runAnalysis(context.TODO(), clientsInv, resourceNames, newConfigPaths("testcases/"))
 	assert.Equal(t, `invalid character 'c' looking for beginning of object key string`, err.Error())
 
 	cInv = NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -2275,18 +2306,18 @@ func TestRunAnalysis(t *testing.T) {
 	_ = os.MkdirAll("testcases/runanalysis/templates", os.ModePerm)
 	_ = os.MkdirAll("testcases/runanalysis/provider", os.ModePerm)
 	_ = os.MkdirAll("testcases/runanalysis/secrets", os.ModePerm)
-	_, err = runAnalysis(clientsInv, resourceNames, "testcases/")
+	_, err = runAnalysis(context.TODO(), clientsInv, resourceNames, newConfigPaths("testcases/"))
 	assert.Equal(t, `analysis Error: Error in post processing canary Response: invalid character 'c' looking for beginning of object key string`, err.Error())
 
-	_, err = runAnalysis(clients, resourceNames, "testcasesy/")
-	assert.Equal(t, "provider config map validation error: open testcasesy/provider/providerConfig: no such file or directory\n Action Required: Provider config map has to be mounted on '/etc/config/provider' in AnalysisTemplate and must carry data element 'providerConfig'", err.Error())
+	_, err = runAnalysis(context.TODO(), clients, resourceNames, newConfigPaths("testcasesy/"))
+	assert.Equal(t, "provider config map validation error: open testcasesy/provider/providerConfig: no such file or directory\n Action Required: Provider config map has to be mounted on 'testcasesy/provider' in AnalysisTemplate and must carry data element 'providerConfig'", err.Error())
 
 	emptyFile, _ = os.Create("testcases/runanalysis/provider/providerConfig")
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/analysis/providerConfig")
 	_ = os.WriteFile("testcases/runanalysis/provider/providerConfig", input, 0644)
-	_, err = runAnalysis(clients, resourceNames, "testcases/runanalysis/")
-	assert.Equal(t, "opsmx profile secret validation error: open testcases/runanalysis/secrets/user: no such file or directory\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'user'", err.Error())
+	_, err = runAnalysis(context.TODO(), clients, resourceNames, newConfigPaths("testcases/runanalysis/"))
+	assert.Equal(t, "opsmx profile secret validation error: open testcases/runanalysis/secrets/user: no such file or directory\n Action Required: secret file has to be mounted on 'testcases/runanalysis/secrets' in AnalysisTemplate and must carry data element 'user'", err.Error())
 
 	emptyFile, _ = os.Create("testcases/runanalysis/secrets/user")
 	emptyFile.Close()
@@ -2309,20 +2340,20 @@ func TestRunAnalysis(t *testing.T) {
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/analysis/provideConfigGitops")
 	_ = os.WriteFile("testcases/runanalysis/provider/providerConfig", input, 0644)
-	_, err = runAnalysis(clients, resourceNames, "testcases/runanalysis/")
-	assert.Equal(t, "gitops 'loggytemp' template config map validation error: open testcases/runanalysis/templates/loggytemp: no such file or directory\n Action Required: Template has to be mounted on '/etc/config/templates' in AnalysisTemplate and must carry data element 'loggytemp'", err.Error())
+	_, err = runAnalysis(context.TODO(), clients, resourceNames, newConfigPaths("testcases/runanalysis/"))
+	assert.Equal(t, "gitops 'loggytemp' template config map validation error: open testcases/runanalysis/templates/loggytemp: no such file or directory\n Action Required: Template has to be mounted on 'testcases/runanalysis/templates' in AnalysisTemplate and must carry data element 'loggytemp'", err.Error())
 
 	emptyFile, _ = os.Create("testcases/provider/providerConfig")
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/analysis/basicCheckFail")
 	_ = os.WriteFile("testcases/provider/providerConfig", input, 0644)
-	_, err = runAnalysis(clients, resourceNames, "testcases/")
+	_, err = runAnalysis(context.TODO(), clients, resourceNames, newConfigPaths("testcases/"))
 	assert.Equal(t, "provider config map validation error: intervalTime should be given along with lookBackType to perform interval analysis", err.Error())
 	emptyFile, _ = os.Create("testcases/provider/providerConfig")
 	emptyFile.Close()
 	input, _ = os.ReadFile("testcases/analysis/failtimevariables")
 	_ = os.WriteFile("testcases/provider/providerConfig", input, 0644)
-	_, err = runAnalysis(clients, resourceNames, "testcases/")
+	_, err = runAnalysis(context.TODO(), clients, resourceNames, newConfigPaths("testcases/"))
 	assert.Equal(t, "provider config map validation error: Error in parsing baselineStartTime: parsing time \"abc\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"abc\" as \"2006\"", err.Error())
 
 	emptyFile, _ = os.Create("testcases/runanalysis/provider/providerConfig")
@@ -2369,7 +2400,7 @@ func TestRunAnalysis(t *testing.T) {
 	})
 	k8sclientS := jobFakeClient(cond)
 	clientsS := newClients(k8sclientS, cS)
-	_, err = runAnalysis(clientsS, resourceNames, "testcases/runanalysis/")
+	_, err = runAnalysis(context.TODO(), clientsS, resourceNames, newConfigPaths("testcases/runanalysis/"))
 	assert.Equal(t, nil, err)
 
 	cCancel := NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -2412,7 +2443,7 @@ func TestRunAnalysis(t *testing.T) {
 	})
 	k8sclientCancel := jobFakeClient(cond)
 	clientsCancel := newClients(k8sclientCancel, cCancel)
-	_, err = runAnalysis(clientsCancel, resourceNames, "testcases/runanalysis/")
+	_, err = runAnalysis(context.TODO(), clientsCancel, resourceNames, newConfigPaths("testcases/runanalysis/"))
 	assert.Equal(t, nil, err)
 
 	cHead := NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -2428,7 +2459,7 @@ func TestRunAnalysis(t *testing.T) {
 		}, nil
 	})
 	clientsHead := newClients(k8sclientCancel, cHead)
-	_, err = runAnalysis(clientsHead, resourceNames, "testcases/runanalysis/")
+	_, err = runAnalysis(context.TODO(), clientsHead, resourceNames, newConfigPaths("testcases/runanalysis/"))
 	assert.Equal(t, "analysis Error: score url not found", err.Error())
 
 	cError := NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -2447,7 +2478,7 @@ func TestRunAnalysis(t *testing.T) {
 		}, nil
 	})
 	clientsError := newClients(k8sclientCancel, cError)
-	_, err = runAnalysis(clientsError, resourceNames, "testcases/runanalysis/")
+	_, err = runAnalysis(context.TODO(), clientsError, resourceNames, newConfigPaths("testcases/runanalysis/"))
 	assert.Equal(t, "analysis Error: Here is Error\nMessage: Error is Here", err.Error())
 
 	resourceNames = ResourceNames{
@@ -2455,7 +2486,7 @@ func TestRunAnalysis(t *testing.T) {
 		jobName: "job",
 	}
 	clientsPatchError := newClients(getFakeClient(map[string][]byte{}), c)
-	_, err = runAnalysis(clientsPatchError, resourceNames, "testcases/runanalysis/")
+	_, err = runAnalysis(context.TODO(), clientsPatchError, resourceNames, newConfigPaths("testcases/runanalysis/"))
 	assert.Equal(t, "jobs.batch \"job\" not found", err.Error())
 
 	cUrlEroor := NewTestClient(func(req *http.Request) (*http.Response, error) {
@@ -2465,7 +2496,7 @@ func TestRunAnalysis(t *testing.T) {
 		}, errors.New("Post \"https://opsmx.invalidurl.tst\": dial tcp: lookup https://opsmx.invalidurl.tst: no such host")
 	})
 	clientsUrlError := newClients(k8sclientS, cUrlEroor)
-	_, err = runAnalysis(clientsUrlError, resourceNames, "testcases/runanalysis/")
+	_, err = runAnalysis(context.TODO(), clientsUrlError, resourceNames, newConfigPaths("testcases/runanalysis/"))
 	assert.Equal(t, "provider config map validation error: incorrect opsmxIsdUrl", err.Error())
 	if _, err := os.Stat("testcases/secrets"); !os.IsNotExist(err) {
 		os.RemoveAll("testcases/secrets")
@@ -2484,7 +2515,7 @@ func TestRunAnalysis(t *testing.T) {
 func TestRunner(t *testing.T) {
 	httpclient := NewHttpClient()
 	clients := newClients(getFakeClient(map[string][]byte{}), httpclient)
-	err := runner(clients)
+	err := runner(context.TODO(), clients, RunOptions{})
 	assert.Equal(t, "analysisTemplate validation error: environment variable MY_POD_NAME is not set", err.Error())
 
 	cd := CanaryDetails{
@@ -2500,6 +2531,1480 @@ func TestRunner(t *testing.T) {
 	k8sclient := jobFakeClient(cond)
 	clients = newClients(k8sclient, httpclient)
 	os.Setenv("MY_POD_NAME", "pod")
-	err = runner(clients)
+	err = runner(context.TODO(), clients, RunOptions{})
 	assert.Equal(t, "pods \"pod\" not found", err.Error())
+
+	resourceNames, err := checkPatchabilityReturnResources(context.TODO(), clients, "jobname-123")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ResourceNames{jobName: "jobname-123"}, resourceNames)
+
+	_, err = getProviderConfigNameFromJob(context.TODO(), newClients(nil, httpclient), resourceNames)
+	assert.Equal(t, "provider config map validation error: application has to be set in the provider config map or through the APP_NAME environment variable when Kubernetes is not used", err.Error())
+}
+
+// setupConfigDir lays out a config directory like /etc/config with the given provider config
+func setupConfigDir(t *testing.T, providerConfig string) string {
+	basePath := t.TempDir()
+	files := map[string]string{
+		"provider/providerConfig":            providerConfig,
+		"templates/loggytemp":                "testcases/gitops/loggytemp",
+		"templates/PrometheusMetricTemplate": "testcases/gitops/PrometheusMetricTemplate",
+		"secrets/user":                       "testcases/secret/user",
+		"secrets/opsmxIsdUrl":                "testcases/secret/gate-url",
+		"secrets/sourceName":                 "testcases/secret/source-name",
+		"secrets/cdIntegration":              "testcases/secret/cd-Integration-False",
+	}
+	for dest, src := range files {
+		input, err := os.ReadFile(src)
+		assert.Equal(t, nil, err)
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(basePath, dest)), os.ModePerm)
+		_ = os.WriteFile(filepath.Join(basePath, dest), input, 0644)
+	}
+	return basePath
+}
+
+func TestDryRun(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected %s request to %s during a dry run", req.Method, req.URL)
+		return nil, errors.New("unexpected request")
+	})
+	basePath := setupConfigDir(t, "testcases/analysis/provideConfigGitops")
+	var out bytes.Buffer
+	err := dryRun(newClients(nil, c), newConfigPaths(basePath), &out)
+	assert.Equal(t, nil, err)
+	assert.Contains(t, out.String(), "# gitops LOG template loggytemp\n")
+	assert.Contains(t, out.String(), "# gitops METRIC template PrometheusMetricTemplate\n")
+	assert.Contains(t, out.String(), "# registerCanary payload\n")
+	assert.Contains(t, out.String(), `"templateSha1":"`+generateSHA1(readTestFile(t, "testcases/gitops/loggytemp"))+`"`)
+	assert.Contains(t, out.String(), `"application":"final-job","sourceName":"argocd06","sourceType":"argorollouts"`)
+
+	basePath = setupConfigDir(t, "testcases/analysis/basicCheckFail")
+	err = dryRun(newClients(nil, c), newConfigPaths(basePath), &out)
+	assert.Equal(t, "provider config map validation error: intervalTime should be given along with lookBackType to perform interval analysis", err.Error())
+}
+
+func readTestFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	assert.Equal(t, nil, err)
+	return string(data)
+}
+
+func TestValidateConfig(t *testing.T) {
+	basePath := setupConfigDir(t, "testcases/analysis/provideConfigGitops")
+	report := validateConfig(newConfigPaths(basePath))
+	assert.Equal(t, 0, report.count())
+
+	providerConfig := `
+application: final-job
+lifetimeMinutes: 2
+lookBackType: sliding
+gitops: true
+passScore: 80
+serviceList:
+  - serviceName: frontend
+    logScopeVariables: kubernetes.pod_name
+    baselineLogScope: 'baseline,extra'
+    logTemplateName: loggytemp
+  - serviceName: frontend
+    metricScopeVariables: 'namespace_key'
+    baselineMetricScope: 'argocd'
+    canaryMetricScope: 'argocd'
+    metricTemplateName: missingtemplate
+`
+	_ = os.WriteFile(filepath.Join(basePath, "provider/providerConfig"), []byte(providerConfig), 0644)
+	input, _ := os.ReadFile("testcases/gitops/invalid/loggytemp.txt")
+	_ = os.WriteFile(filepath.Join(basePath, "templates/loggytemp"), input, 0644)
+	report = validateConfig(newConfigPaths(basePath))
+	assert.Equal(t, []string{"providerConfig", "service 'frontend'", "template 'loggytemp'", "template 'missingtemplate'"}, report.groups)
+	assert.Equal(t, 2, len(report.errors["providerConfig"]))
+	assert.Equal(t, "provider config map validation error: lifetimeMinutes cannot be less than 3 minutes", report.errors["providerConfig"][0].Error())
+	assert.Equal(t, "provider config map validation error: intervalTime should be given along with lookBackType to perform interval analysis", report.errors["providerConfig"][1].Error())
+	assert.Equal(t, []error{
+		errors.New("provider config map validation error: missing canary for log analysis of service 'frontend'"),
+		errors.New("provider config map validation error: mismatch in number of log scope variables and baseline/canary log scope of service 'frontend'"),
+		errors.New("provider config map validation error: serviceName 'frontend' mentioned in provider Config exists more than once"),
+	}, report.errors["service 'frontend'"])
+	assert.Equal(t, 7, report.count())
+
+	var out bytes.Buffer
+	report.print(&out)
+	assert.Contains(t, out.String(), "service 'frontend':\n  - provider config map validation error: missing canary for log analysis of service 'frontend'\n")
+	assert.Contains(t, out.String(), "found 7 validation error(s)\n")
+	assert.Equal(t, 1, validateCommand([]string{basePath}, &out))
+
+	report = validateConfig(newConfigPaths("incorrect/"))
+	assert.Equal(t, 1, report.count())
+}
+
+func TestConfigPaths(t *testing.T) {
+	paths := newConfigPaths("/etc/config/")
+	assert.Equal(t, ConfigPaths{
+		providerConfig: "/etc/config/provider/providerConfig",
+		templates:      "/etc/config/templates",
+		secrets:        "/etc/config/secrets",
+	}, paths)
+	os.Setenv("TEMPLATES_DIR", "/projected/templates")
+	assert.Equal(t, "/projected/templates", getEnvOrDefault("TEMPLATES_DIR", paths.templates))
+	os.Unsetenv("TEMPLATES_DIR")
+	assert.Equal(t, "/etc/config/templates", getEnvOrDefault("TEMPLATES_DIR", paths.templates))
+}
+
+func TestCanaryStatus(t *testing.T) {
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, "https://opsmx.test.tst/autopilot/v5/canaries/1424", req.URL.String())
+		assert.Equal(t, "admin", req.Header.Get("x-spinnaker-user"))
+		assert.Equal(t, "token-123", req.Header.Get("x-opsmx-report-token"))
+		return &http.Response{
+			StatusCode: 200,
+			Body: io.NopCloser(bytes.NewBufferString(`
+			{
+				"canaryResult": {
+					"canaryReportURL": "https://opsmx.test.tst/ui/application/deploymentverification/testapp/1424",
+					"overallScore": 72.6
+				},
+				"id": "1424",
+				"status": {
+					"complete": true,
+					"status": "COMPLETED"
+				}}
+			`)),
+			Header: make(http.Header),
+		}, nil
+	})
+	status, err := getCanaryStatus(context.TODO(), newISDClient(c, map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}, RetryPolicy{}), "1424", "token-123", OPSMXMetric{Pass: 80})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CanaryStatus{
+		canaryId:  "1424",
+		status:    "COMPLETED",
+		score:     "73",
+		phase:     AnalysisPhaseFailed,
+		reportUrl: "https://opsmx.test.tst/ui/application/deploymentverification/testapp/1424",
+	}, status)
+	assert.Equal(t, ReturnCodeFailed, status.exitCode())
+	var out bytes.Buffer
+	status.print(&out)
+	assert.Contains(t, out.String(), "phase:     Failed\n")
+
+	status, err = getCanaryStatus(context.TODO(), newISDClient(c, map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}, RetryPolicy{}), "1424", "token-123", OPSMXMetric{Pass: 70})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, AnalysisPhaseSuccessful, status.phase)
+	assert.Equal(t, ReturnCodeSuccess, status.exitCode())
+
+	cInv := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{canaryId: 1424}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	_, err = getCanaryStatus(context.TODO(), newISDClient(cInv, map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}, RetryPolicy{}), "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, "analysis Error: Error in post processing canary Response: invalid character 'c' looking for beginning of object key string", err.Error())
+
+	_, err = readSecretKey("", "testcases/nothere", "user")
+	assert.Equal(t, "opsmx profile secret validation error: `user` key not present in the secret file and not given as a flag", err.Error())
+	user, err := readSecretKey("", "testcases/secret", "user")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "admins", user)
+}
+
+func TestRunAnalysisTermination(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelledUrl string
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		response := `{}`
+		header := make(http.Header)
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/registerCanary"):
+			response = `{"canaryId": 1424}`
+			header.Set("Location", "https://isd.opsmx.net/autopilot/v5/canaries/1424")
+		case strings.HasSuffix(req.URL.Path, "/cancel"):
+			cancelledUrl = req.URL.String()
+		case strings.HasSuffix(req.URL.Path, "/canaries/1424"):
+			//the pod gets SIGTERM while the canary is running
+			cancel()
+			response = `{"canaryResult": {"canaryReportURL": "https://isd.opsmx.net/report/1424"}, "status": {"status": "RUNNING"}}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(response)),
+			Header:     header,
+		}, nil
+	})
+	k8sclient := jobFakeClient(batchv1.JobCondition{})
+	resourceNames := ResourceNames{
+		podName: "podName",
+		jobName: "jobname-123",
+	}
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	exitCode, err := runAnalysis(ctx, newClients(k8sclient, c), resourceNames, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeCancelled, exitCode)
+	assert.Equal(t, "https://isd.opsmx.net/autopilot/api/v5/canaries/1424/cancel", cancelledUrl)
+	lastPatch := k8sclient.Actions()[len(k8sclient.Actions())-1].(kubetesting.PatchAction)
+	assert.Contains(t, string(lastPatch.GetPatch()), "The analysis has Cancelled")
+
+	//nothing is registered when the job is stopped before the payload is sent
+	cancelledUrl = ""
+	exitCode, err = runAnalysis(ctx, newClients(jobFakeClient(batchv1.JobCondition{}), c), resourceNames, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeCancelled, exitCode)
+	assert.Equal(t, "", cancelledUrl)
+
+	//the canary registered while the job was asked to stop is cancelled in ISD
+	registerCtx, cancelRegister := context.WithCancel(context.Background())
+	defer cancelRegister()
+	c = NewTestClient(func(req *http.Request) (*http.Response, error) {
+		response := `{}`
+		header := make(http.Header)
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/registerCanary"):
+			//the pod gets SIGTERM during the round trip, ISD has registered the canary
+			cancelRegister()
+			response = `{"canaryId": 1424}`
+			header.Set("Location", "https://isd.opsmx.net/autopilot/v5/canaries/1424")
+		case strings.HasSuffix(req.URL.Path, "/cancel"):
+			cancelledUrl = req.URL.String()
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(response)),
+			Header:     header,
+		}, nil
+	})
+	exitCode, err = runAnalysis(registerCtx, newClients(jobFakeClient(batchv1.JobCondition{}), c), resourceNames, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeCancelled, exitCode)
+	assert.Equal(t, "https://isd.opsmx.net/autopilot/api/v5/canaries/1424/cancel", cancelledUrl)
+}
+
+func TestRunAnalysisResume(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/registerCanary") {
+			t.Errorf("the canary registered by the previous pod should be resumed")
+		}
+		response := `{}`
+		if req.URL.Path == "/autopilot/v5/canaries/1424" {
+			assert.Equal(t, "https://isd.opsmx.net/autopilot/v5/canaries/1424", req.URL.String())
+			response = `{"canaryResult": {"canaryReportURL": "https://isd.opsmx.net/report/1424", "overallScore": 90}, "status": {"status": "COMPLETED"}}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(response)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	cd := CanaryDetails{
+		user:      "admin",
+		canaryId:  "1424",
+		reportUrl: "https://isd.opsmx.net/report/1424",
+		ReportId:  "token-123",
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jobname-123",
+			Namespace: defaults.Namespace(),
+		},
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{{
+				Message: fmt.Sprintf("analysisDetails\n user: %s\n canaryID: %s\n reportURL: %s\n reportId: %s", cd.user, cd.canaryId, cd.reportUrl, cd.ReportId),
+				Type:    "OpsmxAnalysis",
+				Status:  "True",
+			}},
+		},
+	}
+	k8sclient := k8sfake.NewSimpleClientset(job)
+	resourceNames := ResourceNames{
+		podName: "podName",
+		jobName: "jobname-123",
+	}
+	assert.Equal(t, cd, getRegisteredCanary(context.TODO(), newClients(k8sclient, c), resourceNames))
+	assert.Equal(t, CanaryDetails{}, getRegisteredCanary(context.TODO(), newClients(k8sclient, c), ResourceNames{jobName: "other"}))
+	assert.Equal(t, CanaryDetails{}, parseCanaryDetails("some error message"))
+
+	//the document written since the message is versioned is read back the same way
+	registeredAt := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	message, err := CanaryDetails{user: "admin", canaryId: "1424", ReportId: "token-123", phase: AnalysisPhaseRunning, registeredAt: registeredAt}.message()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, CanaryDetails{user: "admin", canaryId: "1424", ReportId: "token-123", phase: AnalysisPhaseRunning, registeredAt: registeredAt}, parseCanaryDetails(message))
+
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	exitCode, err := runAnalysis(context.TODO(), newClients(k8sclient, c), resourceNames, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeSuccess, exitCode)
+	lastPatch := k8sclient.Actions()[len(k8sclient.Actions())-1].(kubetesting.PatchAction)
+	assert.Contains(t, string(lastPatch.GetPatch()), `{\"version\":\"v1\",\"user\":\"admin\",\"canaryId\":\"1424\",\"reportUrl\":\"https://isd.opsmx.net/report/1424\",\"reportId\":\"token-123\",\"score\":\"90\",\"phase\":\"Successful\"`)
+}
+
+func TestRpcPlugin(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	status := "RUNNING"
+	var cancelledUrl string
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		response := `{}`
+		header := make(http.Header)
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/registerCanary"):
+			response = `{"canaryId": 1424}`
+			header.Set("Location", "https://isd.opsmx.net/autopilot/v5/canaries/1424")
+			header.Set("x-opsmx-report-token", "token-123")
+		case strings.HasSuffix(req.URL.Path, "/cancel"):
+			cancelledUrl = req.URL.String()
+		case strings.HasSuffix(req.URL.Path, "/canaries/1424"):
+			assert.Equal(t, "token-123", req.Header.Get("x-opsmx-report-token"))
+			response = `{"canaryResult": {"canaryReportURL": "https://isd.opsmx.net/report/1424", "overallScore": 90}, "status": {"status": "` + status + `"}}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(response)),
+			Header:     header,
+		}, nil
+	})
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	p := &RpcPlugin{
+		clients: newClients(nil, c),
+		paths:   newConfigPaths(basePath),
+	}
+	metric := v1alpha1.Metric{
+		Name: "opsmx",
+		Provider: v1alpha1.MetricProvider{
+			Plugin: map[string]json.RawMessage{
+				"opsmx/isd": json.RawMessage(`{
+					"application": "final-job",
+					"opsmxIsdUrl": "https://isd.opsmx.net/",
+					"lifetimeMinutes": 3,
+					"passScore": 80,
+					"serviceList": [{
+						"logScopeVariables": "kubernetes.pod_name",
+						"baselineLogScope": ".*{{env.STABLE_POD_HASH}}.*",
+						"canaryLogScope": ".*{{env.LATEST_POD_HASH}}.*",
+						"logTemplateName": "loggytemp"
+					}]
+				}`),
+			},
+		},
+	}
+	ar := &v1alpha1.AnalysisRun{ObjectMeta: metav1.ObjectMeta{Name: "analysisrun"}}
+
+	measurement := p.Run(ar, metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.Equal(t, map[string]string{"canaryId": "1424", "reportId": "token-123"}, measurement.Metadata)
+	assert.NotNil(t, measurement.ResumeAt)
+
+	measurement = p.Resume(ar, metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseRunning, measurement.Phase)
+	assert.Equal(t, "https://isd.opsmx.net/report/1424", measurement.Metadata["reportUrl"])
+
+	status = "COMPLETED"
+	resumed := p.Resume(ar, metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, resumed.Phase)
+	assert.Equal(t, "90", resumed.Value)
+	assert.NotNil(t, resumed.FinishedAt)
+
+	status = "CANCELLED"
+	resumed = p.Resume(ar, metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, resumed.Phase)
+	assert.Equal(t, "analysis Error: canary ID 1424 was cancelled in ISD", resumed.Message)
+
+	terminated := p.Terminate(ar, metric, measurement)
+	assert.Equal(t, v1alpha1.AnalysisPhaseSuccessful, terminated.Phase)
+	assert.Equal(t, "https://isd.opsmx.net/autopilot/api/v5/canaries/1424/cancel", cancelledUrl)
+
+	metric.Provider.Plugin = map[string]json.RawMessage{"opsmx/isd": json.RawMessage(`{"lifetimeMinutes": 3}`)}
+	measurement = p.Run(ar, metric)
+	assert.Equal(t, v1alpha1.AnalysisPhaseError, measurement.Phase)
+	assert.Equal(t, "provider config map validation error: application has to be set in the plugin config or through the argocd.argoproj.io/instance label of the AnalysisRun", measurement.Message)
+}
+
+func TestCanaryServer(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	var statusRequests atomic.Int64
+	//stand-in ISD
+	isd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/registerCanary"):
+			w.Header().Set("Location", "http://"+r.Host+"/autopilot/v5/canaries/1424")
+			_, _ = io.WriteString(w, `{"canaryId": 1424}`)
+		case strings.HasSuffix(r.URL.Path, "/canaries/1424"):
+			statusRequests.Add(1)
+			_, _ = io.WriteString(w, `{"canaryResult": {"canaryReportURL": "https://isd.opsmx.net/report/1424", "overallScore": 90}, "status": {"status": "COMPLETED"}}`)
+		default:
+			_, _ = io.WriteString(w, `{}`)
+		}
+	}))
+	defer isd.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//opsmxIsdUrl is only read from the mounted secret
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	_ = os.WriteFile(filepath.Join(basePath, "secrets/opsmxIsdUrl"), []byte(isd.URL), 0644)
+	s := newCanaryServer(newClients(nil, NewHttpClient()), newConfigPaths(basePath))
+	server := httptest.NewServer(s.handler(ctx))
+	defer server.Close()
+
+	providerConfig := `{
+		"application": "final-job",
+		"lifetimeMinutes": 3,
+		"passScore": 80,
+		"poll": {"interval": 0.01, "interimResults": true},
+		"serviceList": [{
+			"logScopeVariables": "kubernetes.pod_name",
+			"baselineLogScope": ".*{{env.STABLE_POD_HASH}}.*",
+			"canaryLogScope": ".*{{env.LATEST_POD_HASH}}.*",
+			"logTemplateName": "loggytemp"
+		}]
+	}`
+	res, err := http.Post(server.URL+"/canaries/", "application/json", bytes.NewBufferString(providerConfig))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "/canaries/1424", res.Header.Get("Location"))
+	var canary ServedCanary
+	_ = json.NewDecoder(res.Body).Decode(&canary)
+	res.Body.Close()
+	assert.Equal(t, ServedCanary{CanaryId: "1424", Status: "RUNNING", Phase: AnalysisPhaseRunning}, canary)
+
+	assert.Eventually(t, func() bool {
+		canary, _ := s.get("1424")
+		return canary.Status == "COMPLETED"
+	}, time.Second, 10*time.Millisecond)
+	res, err = http.Get(server.URL + "/canaries/1424")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	_ = json.NewDecoder(res.Body).Decode(&canary)
+	res.Body.Close()
+	assert.Equal(t, ServedCanary{
+		CanaryId:  "1424",
+		Status:    "COMPLETED",
+		Score:     "90",
+		Phase:     AnalysisPhaseSuccessful,
+		ReportUrl: "https://isd.opsmx.net/report/1424",
+	}, canary)
+
+	res, err = http.Get(server.URL + "/canaries/1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+
+	res, err = http.Post(server.URL+"/canaries/", "application/json", bytes.NewBufferString(`{"lifetimeMinutes": 3}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	//without interim results the score is not asked before the end of the window
+	polled := statusRequests.Load()
+	res, err = http.Post(server.URL+"/canaries/", "application/json", bytes.NewBufferString(strings.Replace(providerConfig, `"interimResults": true`, `"interimResults": false`, 1)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, polled, statusRequests.Load())
+
+	//a posted opsmxIsdUrl would receive the credentials of the secret
+	res, err = http.Post(server.URL+"/canaries/", "application/json", bytes.NewBufferString(strings.Replace(providerConfig, `"application": "final-job",`, `"application": "final-job", "opsmxIsdUrl": "https://attacker.example.com",`, 1)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	res, err = http.Post(server.URL+"/canaries/", "application/json", bytes.NewBufferString(strings.Repeat(" ", maxProviderConfigBytes+1)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestCanaryServerLimits(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	isd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/registerCanary"):
+			w.Header().Set("Location", "http://"+r.Host+"/autopilot/v5/canaries/1424")
+			_, _ = io.WriteString(w, `{"canaryId": 1424}`)
+		case strings.HasSuffix(r.URL.Path, "/canaries/1424"):
+			_, _ = io.WriteString(w, `{"canaryResult": {"overallScore": 90}, "status": {"status": "COMPLETED"}}`)
+		default:
+			_, _ = io.WriteString(w, `{}`)
+		}
+	}))
+	defer isd.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	_ = os.WriteFile(filepath.Join(basePath, "secrets/opsmxIsdUrl"), []byte(isd.URL), 0644)
+	s := newCanaryServer(newClients(nil, NewHttpClient()), newConfigPaths(basePath))
+	s.ttl = 10 * time.Millisecond
+	s.maxCanaries = 1
+	server := httptest.NewServer(s.handler(ctx))
+	defer server.Close()
+	post := func(interimResults bool) int {
+		providerConfig := fmt.Sprintf(`{"application": "final-job", "lifetimeMinutes": 3, "passScore": 80, "poll": {"interval": 0.01, "interimResults": %t}, "serviceList": [{"logScopeVariables": "kubernetes.pod_name", "baselineLogScope": ".*{{env.STABLE_POD_HASH}}.*", "canaryLogScope": ".*{{env.LATEST_POD_HASH}}.*", "logTemplateName": "loggytemp"}]}`, interimResults)
+		res, err := http.Post(server.URL+"/canaries/", "application/json", bytes.NewBufferString(providerConfig))
+		assert.Equal(t, nil, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	//a finished canary is removed once its ttl has passed
+	assert.Equal(t, http.StatusCreated, post(true))
+	assert.Eventually(t, func() bool {
+		_, ok := s.get("1424")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	//a canary still running holds its place until it has finished
+	assert.Equal(t, http.StatusCreated, post(false))
+	assert.Equal(t, http.StatusServiceUnavailable, post(false))
+}
+
+// fakeISD answers like ISD without going through http
+type fakeISD struct {
+	templates map[string]bool
+	saved     []TemplateRequest
+	payloads  []string
+	statuses  []CanaryStatusResponse
+	cancelled []string
+	saveError string
+}
+
+func (f *fakeISD) RegisterCanary(ctx context.Context, req RegisterCanaryRequest) (RegisterCanaryResponse, error) {
+	f.payloads = append(f.payloads, req.Payload)
+	return RegisterCanaryResponse{
+		CanaryId:    "1424",
+		ScoreUrl:    "https://isd.opsmx.net/autopilot/v5/canaries/1424",
+		ReportToken: "token-123",
+	}, nil
+}
+
+func (f *fakeISD) GetCanaryStatus(ctx context.Context, req CanaryStatusRequest) (CanaryStatusResponse, error) {
+	status := f.statuses[0]
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+	return status, nil
+}
+
+func (f *fakeISD) VerifyTemplate(ctx context.Context, req TemplateRequest) (bool, error) {
+	return f.templates[req.Name], nil
+}
+
+func (f *fakeISD) SaveTemplate(ctx context.Context, req TemplateRequest) (SaveTemplateResponse, error) {
+	f.saved = append(f.saved, req)
+	if f.saveError != "" {
+		return SaveTemplateResponse{Status: 400.0, ErrorMessage: []interface{}{f.saveError}}, nil
+	}
+	return SaveTemplateResponse{Status: "CREATED"}, nil
+}
+
+func (f *fakeISD) CancelCanary(ctx context.Context, req CancelCanaryRequest) error {
+	f.cancelled = append(f.cancelled, req.CanaryId)
+	return nil
+}
+
+func canaryStatusResponse(t *testing.T, data string) CanaryStatusResponse {
+	var status CanaryStatusResponse
+	assert.Equal(t, nil, json.Unmarshal([]byte(data), &status))
+	return status
+}
+
+func TestRunAnalysisFakeISD(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		//only the reachability check of checkISDUrl goes through http
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	isd := &fakeISD{
+		templates: map[string]bool{"PrometheusMetricTemplate": true},
+		statuses: []CanaryStatusResponse{
+			canaryStatusResponse(t, `{"canaryResult": {"canaryReportURL": "https://isd.opsmx.net/report/1424", "overallScore": 70}, "status": {"status": "COMPLETED"}}`),
+		},
+	}
+	clients := newClients(jobFakeClient(batchv1.JobCondition{}), c)
+	clients.isd = isd
+	basePath := setupConfigDir(t, "testcases/analysis/provideConfigGitops")
+	exitCode, err := runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeFailed, exitCode)
+	assert.Equal(t, 1, len(isd.payloads))
+	assert.Equal(t, 1, len(isd.saved))
+	assert.Equal(t, "loggytemp", isd.saved[0].Name)
+	assert.Equal(t, "LOG", isd.saved[0].Type)
+	assert.Contains(t, isd.payloads[0], `"templateSha1":"`+isd.saved[0].Sha1+`"`)
+
+	sha1, err := getTemplateData(context.TODO(), isd, "loggytemp", "LOG", filepath.Join(basePath, "templates"), "kubernetes.pod_name")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, isd.saved[0].Sha1, sha1)
+	isd.saveError = "template is invalid"
+	_, err = getTemplateData(context.TODO(), isd, "loggytemp", "LOG", filepath.Join(basePath, "templates"), "kubernetes.pod_name")
+	assert.Equal(t, "gitops 'loggytemp' template config map validation error: template is invalid", err.Error())
+}
+
+func TestRetryPolicy(t *testing.T) {
+	attempts := 0
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		switch {
+		case attempts == 1:
+			return nil, syscall.ECONNRESET
+		case attempts == 2:
+			return &http.Response{
+				StatusCode: 503,
+				Status:     "503 Service Unavailable",
+				Body:       io.NopCloser(bytes.NewBufferString(``)),
+				Header:     make(http.Header),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"canaryResult": {"overallScore": 90}, "status": {"status": "COMPLETED"}}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	retry := RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	secretData := map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}
+	status, err := getCanaryStatus(context.TODO(), newISDClient(c, secretData, retry), "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, AnalysisPhaseSuccessful, status.phase)
+
+	//out of attempts
+	attempts = 0
+	_, err = getCanaryStatus(context.TODO(), newISDClient(c, secretData, RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond}), "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, "analysis Error: GET /autopilot/v5/canaries/1424 returned 503 Service Unavailable", err.Error())
+
+	//permanent failures are not retried
+	attempts = 0
+	err = retry.do(context.TODO(), "test", func() error {
+		attempts++
+		return errors.New("analysis Error: invalid payload")
+	})
+	assert.Equal(t, "analysis Error: invalid payload", err.Error())
+	assert.Equal(t, 1, attempts)
+
+	//only timeouts and broken connections are transient on the client side
+	retryable := map[error]bool{
+		&url.Error{Op: "Get", URL: "https://opsmx.test.tst", Err: os.ErrDeadlineExceeded}:                                       true,
+		&url.Error{Op: "Get", URL: "https://opsmx.test.tst", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}:            true,
+		&url.Error{Op: "Get", URL: "https://opsmx.test.tst", Err: syscall.ECONNRESET}:                                           true,
+		&url.Error{Op: "Get", URL: "https://opsmx.test.tst", Err: io.ErrUnexpectedEOF}:                                          true,
+		&url.Error{Op: "Get", URL: "ftp://opsmx.test.tst", Err: errors.New(`unsupported protocol scheme "ftp"`)}:                false,
+		&url.Error{Op: "Get", URL: "https:///canaries", Err: errors.New("http: no Host in request URL")}:                        false,
+		&url.Error{Op: "Get", URL: "https://opsmx.test.tst", Err: errors.New("stopped after 10 redirects")}:                     false,
+		&url.Error{Op: "Get", URL: "https://opsmx.test.tst", Err: errors.New("net/http: HTTP/1.x transport connection broken")}: false,
+	}
+	for err, expected := range retryable {
+		assert.Equal(t, expected, isRetryable(err), err.Error())
+	}
+
+	assert.Equal(t, 2*time.Second, parseRetryAfter("2"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, 5*time.Second, retry.delay(0, &ISDResponseError{StatusCode: 429, RetryAfter: 5 * time.Second}))
+	assert.LessOrEqual(t, retry.delay(10, errors.New("timeout")), 2*time.Millisecond)
+
+	metric := OPSMXMetric{LifetimeMinutes: 3, Retry: RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: time.Second}}
+	assert.Equal(t, "provider config map validation error: retry maxDelay cannot be less than baseDelay", metric.basicChecks().Error())
+}
+
+func TestISDAuth(t *testing.T) {
+	secretsPath := filepath.Join(setupConfigDir(t, "testcases/analysis/providerConfig"), "secrets")
+	writeSecret := func(key string, value string) {
+		_ = os.WriteFile(filepath.Join(secretsPath, key), []byte(value), 0644)
+	}
+	metric := OPSMXMetric{}
+	var header http.Header
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"canaryResult": {"overallScore": 90}, "status": {"status": "COMPLETED"}}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+
+	secretData, err := metric.getDataSecret(secretsPath)
+	assert.Equal(t, nil, err)
+	_, err = getCanaryStatus(context.TODO(), newISDClient(c, secretData, RetryPolicy{}), "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", header.Get("Authorization"))
+
+	writeSecret("authMode", "bearer")
+	_, err = metric.getDataSecret(secretsPath)
+	assert.Equal(t, fmt.Sprintf("opsmx profile secret validation error: `token` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'token' for 'authMode' as 'bearer'", secretsPath), err.Error())
+	writeSecret("token", "secret-token\n")
+	secretData, err = metric.getDataSecret(secretsPath)
+	assert.Equal(t, nil, err)
+	_, err = getCanaryStatus(context.TODO(), newISDClient(c, secretData, RetryPolicy{}), "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "Bearer secret-token", header.Get("Authorization"))
+	assert.Equal(t, "admins", header.Get("x-spinnaker-user"))
+
+	writeSecret("authMode", "apiKey")
+	writeSecret("apiKey", "key-123")
+	secretData, err = metric.getDataSecret(secretsPath)
+	assert.Equal(t, nil, err)
+	_ = metric.checkISDUrl(context.TODO(), newClients(nil, c), secretData)
+	assert.Equal(t, "key-123", header.Get("x-api-key"))
+	writeSecret("apiKeyHeader", "x-opsmx-api-key")
+	secretData, _ = metric.getDataSecret(secretsPath)
+	_, _ = getCanaryStatus(context.TODO(), newISDClient(c, secretData, RetryPolicy{}), "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, "key-123", header.Get("x-opsmx-api-key"))
+
+	writeSecret("authMode", "basic")
+	writeSecret("username", "svc-argo")
+	_, err = metric.getDataSecret(secretsPath)
+	assert.Equal(t, fmt.Sprintf("opsmx profile secret validation error: `password` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'password' for 'authMode' as 'basic'", secretsPath), err.Error())
+	writeSecret("password", "hunter2")
+	secretData, _ = metric.getDataSecret(secretsPath)
+	_, _ = getCanaryStatus(context.TODO(), newISDClient(c, secretData, RetryPolicy{}), "1424", "", OPSMXMetric{Pass: 80})
+	username, password, _ := (&http.Request{Header: header}).BasicAuth()
+	assert.Equal(t, "svc-argo", username)
+	assert.Equal(t, "hunter2", password)
+
+	writeSecret("authMode", "oauth")
+	_, err = metric.getDataSecret(secretsPath)
+	assert.Equal(t, "opsmx profile secret validation error: authMode should be one of bearer, apiKey or basic", err.Error())
+}
+
+func TestISDTLS(t *testing.T) {
+	isd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{}`)
+	}))
+	defer isd.Close()
+	secretsPath := filepath.Join(setupConfigDir(t, "testcases/analysis/providerConfig"), "secrets")
+	writeSecret := func(key string, value []byte) {
+		_ = os.WriteFile(filepath.Join(secretsPath, key), value, 0644)
+	}
+	metric := OPSMXMetric{Retry: RetryPolicy{Attempts: 1}}
+	secretData := map[string]string{"opsmxIsdUrl": isd.URL, "user": "admin"}
+
+	//nothing in the secret, the client is left as it is
+	clients := newClients(nil, NewHttpClient())
+	assert.Equal(t, nil, clients.configureTLS(secretsPath))
+	assert.Equal(t, nil, clients.client.Transport)
+	err := metric.checkISDUrl(context.TODO(), clients, secretData)
+	assert.Contains(t, err.Error(), "opsmx profile secret validation error: TLS handshake with opsmxIsdUrl "+isd.URL+" failed: ")
+
+	writeSecret("ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: isd.Certificate().Raw}))
+	clients = newClients(nil, NewHttpClient())
+	assert.Equal(t, nil, clients.configureTLS(secretsPath))
+	assert.Equal(t, nil, metric.checkISDUrl(context.TODO(), clients, secretData))
+
+	writeSecret("ca.crt", []byte("not a certificate"))
+	assert.Equal(t, "opsmx profile secret validation error: `ca.crt` does not contain a PEM encoded certificate", clients.configureTLS(secretsPath).Error())
+	_ = os.Remove(filepath.Join(secretsPath, "ca.crt"))
+
+	writeSecret("insecureSkipVerify", []byte("true"))
+	clients = newClients(nil, NewHttpClient())
+	assert.Equal(t, nil, clients.configureTLS(secretsPath))
+	assert.Equal(t, nil, metric.checkISDUrl(context.TODO(), clients, secretData))
+	_ = os.Remove(filepath.Join(secretsPath, "insecureSkipVerify"))
+
+	//client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "argo-metricprovider-job"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, nil, err)
+	writeSecret("tls.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	_, err = getTLSConfig(secretsPath)
+	assert.Equal(t, "opsmx profile secret validation error: `tls.crt` and `tls.key` have to be given together for client certificate authentication", err.Error())
+	writeSecret("tls.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}))
+	config, err := getTLSConfig(secretsPath)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(config.Certificates))
+}
+
+func TestISDResponseError(t *testing.T) {
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/registerCanary"):
+			return &http.Response{
+				StatusCode: 401,
+				Status:     "401 Unauthorized",
+				Body:       io.NopCloser(bytes.NewBufferString(`{"message": "invalid token"}`)),
+				Header:     make(http.Header),
+			}, nil
+		case req.Method == "POST":
+			return &http.Response{
+				StatusCode: 500,
+				Status:     "500 Internal Server Error",
+				Body:       io.NopCloser(bytes.NewBufferString(`{"status": 500, "errorMessage": ["Datasource account not found"]}`)),
+				Header:     make(http.Header),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 400,
+			Status:     "400 Bad Request",
+			Body:       io.NopCloser(bytes.NewBufferString(strings.Repeat("x", 600))),
+			Header:     make(http.Header),
+		}, nil
+	})
+	isd := newISDClient(c, map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}, RetryPolicy{Attempts: 1})
+
+	_, err := isd.RegisterCanary(context.TODO(), RegisterCanaryRequest{Payload: `{}`})
+	var responseErr *ISDResponseError
+	assert.True(t, errors.As(err, &responseErr))
+	assert.Equal(t, 401, responseErr.StatusCode)
+	assert.Equal(t, `analysis Error: POST /autopilot/api/v5/registerCanary returned 401 Unauthorized: {"message": "invalid token"}`, err.Error())
+
+	_, err = isd.GetCanaryStatus(context.TODO(), CanaryStatusRequest{CanaryId: "1424"})
+	assert.Equal(t, "analysis Error: GET /autopilot/v5/canaries/1424 returned 400 Bad Request: "+strings.Repeat("x", maxErrorBodyLength)+"...", err.Error())
+
+	//template validation errors come with an error status
+	saved, err := isd.SaveTemplate(context.TODO(), TemplateRequest{Name: "loggytemp", Type: "LOG", Sha1: "sha"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, saved.created())
+	assert.Equal(t, "Datasource account not found", saved.errorMessage())
+}
+
+func TestAnalysisDeadline(t *testing.T) {
+	//the deadline follows the window, which may start after the job or before it for a resumed canary
+	start := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	metric := OPSMXMetric{LifetimeMinutes: 5, Delay: 2, CanaryStartTime: fmt.Sprintf("%d", start.UnixMilli())}
+	assert.WithinDuration(t, start.Add(12*time.Minute), metric.analysisDeadline(), 0)
+	metric.Deadline.GracePeriod = time.Minute
+	assert.WithinDuration(t, start.Add(8*time.Minute), metric.analysisDeadline(), 0)
+	future := OPSMXMetric{LifetimeMinutes: 5, CanaryStartTime: time.Now().Add(time.Hour).Format(time.RFC3339)}
+	assert.Equal(t, nil, future.getTimeVariables())
+	assert.Greater(t, time.Until(future.analysisDeadline()), time.Hour)
+
+	assert.Equal(t, 0, len(DeadlinePolicy{OnTimeout: "Error"}.errors()))
+	assert.Equal(t, "provider config map validation error: deadline gracePeriod cannot be negative", DeadlinePolicy{GracePeriod: -time.Minute}.errors()[0].Error())
+	assert.Equal(t, "provider config map validation error: deadline onTimeout should be either Inconclusive or Error", DeadlinePolicy{OnTimeout: "Pass"}.errors()[0].Error())
+
+	secretData := map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}
+	cd := CanaryDetails{user: "admin", jobName: "jobname-123", canaryId: "1424"}
+	expired, cancel := context.WithDeadline(context.Background(), start)
+	defer cancel()
+
+	//the canary still running in ISD is cancelled and the analysis ends as Inconclusive by default
+	isd := &fakeISD{}
+	clients := newClients(jobFakeClient(batchv1.JobCondition{}), http.Client{})
+	clients.isd = isd
+	exitCode, err := metric.stopAnalysis(expired, clients, secretData, cd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeInconclusive, exitCode)
+	assert.Equal(t, []string{"1424"}, isd.cancelled)
+
+	metric.Deadline.OnTimeout = deadlinePolicyError
+	exitCode, err = metric.stopAnalysis(expired, clients, secretData, cd)
+	assert.Equal(t, ReturnCodeError, exitCode)
+	assert.Equal(t, "analysis Error: the analysis did not finish before its deadline, lifetimeMinutes 5, delay 2 and gracePeriod 1m0s have passed", err.Error())
+	assert.Equal(t, "DeadlineExceeded", errorReason(err))
+
+	//a termination request is not a deadline
+	cancelled, cancelRun := context.WithCancel(context.Background())
+	cancelRun()
+	exitCode, err = metric.stopAnalysis(cancelled, clients, secretData, cd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeCancelled, exitCode)
+}
+
+func TestPollPolicy(t *testing.T) {
+	poll := PollPolicy{}
+	assert.Equal(t, resumeAfter, poll.wait(0))
+	assert.Equal(t, resumeAfter, poll.wait(5))
+
+	poll = PollPolicy{Interval: 10 * time.Second, Backoff: 2, MaxInterval: time.Minute}
+	assert.Equal(t, 10*time.Second, poll.wait(0))
+	assert.Equal(t, 20*time.Second, poll.wait(1))
+	assert.Equal(t, 40*time.Second, poll.wait(2))
+	assert.Equal(t, time.Minute, poll.wait(3))
+
+	//no polling before the window has ended, unless interim results are wanted
+	windowEnd := time.Now().Add(time.Hour)
+	assert.Greater(t, poll.firstWait(windowEnd), 59*time.Minute)
+	assert.Equal(t, 10*time.Second, poll.firstWait(time.Now().Add(-time.Minute)))
+	poll.InterimResults = true
+	assert.Equal(t, 10*time.Second, poll.firstWait(windowEnd))
+
+	metric := OPSMXMetric{LifetimeMinutes: 30, Delay: 5, CanaryStartTime: "1682935200000"}
+	assert.Equal(t, time.UnixMilli(1682935200000).Add(35*time.Minute), metric.windowEnd())
+
+	assert.Equal(t, 0, len(PollPolicy{Interval: time.Minute, Backoff: 1.5}.errors()))
+	assert.Equal(t, "provider config map validation error: poll backoff cannot be less than 1", PollPolicy{Backoff: 0.5}.errors()[0].Error())
+	assert.Equal(t, "provider config map validation error: poll maxInterval cannot be less than interval", PollPolicy{Interval: time.Minute, MaxInterval: time.Second}.errors()[0].Error())
+}
+
+func TestRunAnalysisCanaryStatuses(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	run := func(response string) (ExitCode, error) {
+		clients := newClients(jobFakeClient(batchv1.JobCondition{}), c)
+		clients.isd = &fakeISD{statuses: []CanaryStatusResponse{canaryStatusResponse(t, response)}}
+		return runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+	}
+
+	exitCode, err := run(`{"canaryResult": {"overallScore": 90}, "status": {"status": "COMPLETED"}}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeSuccess, exitCode)
+
+	exitCode, err = run(`{"canaryResult": {"overallScore": 90}, "status": {"status": "CANCELLED"}}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeCancelled, exitCode)
+
+	//a failed analysis is not a failed canary, ISD did not score it
+	exitCode, err = run(`{"canaryResult": {"message": "datasource unreachable"}, "status": {"status": "FAILED"}}`)
+	assert.Equal(t, ReturnCodeError, exitCode)
+	assert.Equal(t, "analysis Error: canary ID 1424 ended with status FAILED in ISD\nMessage: datasource unreachable", err.Error())
+
+	exitCode, err = run(`{"canaryResult": {}, "status": {"status": "ERROR"}}`)
+	assert.Equal(t, ReturnCodeError, exitCode)
+	assert.Equal(t, "analysis Error: canary ID 1424 ended with status ERROR in ISD", err.Error())
+
+	exitCode, err = run(`{"canaryResult": {"overallScore": 0}}`)
+	assert.Equal(t, ReturnCodeError, exitCode)
+	assert.Equal(t, "analysis Error: unknown status \"\" of canary ID 1424 in ISD\nResponse: {\"status\":{\"complete\":false,\"status\":\"\"},\"canaryResult\":{\"overallScore\":0}}", err.Error())
+
+	exitCode, err = run(`{"status": {"status": "PAUSED"}}`)
+	assert.Equal(t, ReturnCodeError, exitCode)
+	assert.Equal(t, "analysis Error: unknown status \"PAUSED\" of canary ID 1424 in ISD\nResponse: {\"status\":{\"complete\":false,\"status\":\"PAUSED\"},\"canaryResult\":{}}", err.Error())
+
+	_, err = getCanaryStatus(context.TODO(), &fakeISD{statuses: []CanaryStatusResponse{canaryStatusResponse(t, `{"status": {"status": "ERROR"}}`)}}, "1424", "", OPSMXMetric{Pass: 80})
+	assert.Equal(t, "analysis Error: canary ID 1424 ended with status ERROR in ISD", err.Error())
+}
+
+func TestInconclusiveScore(t *testing.T) {
+	assert.Equal(t, AnalysisPhaseSuccessful, evaluateResult(80, 80, 60))
+	assert.Equal(t, AnalysisPhaseInconclusive, evaluateResult(79, 80, 60))
+	assert.Equal(t, AnalysisPhaseInconclusive, evaluateResult(60, 80, 60))
+	assert.Equal(t, AnalysisPhaseFailed, evaluateResult(59, 80, 60))
+	assert.Equal(t, AnalysisPhaseFailed, evaluateResult(79, 80, 0))
+
+	metric := OPSMXMetric{LifetimeMinutes: 30, Pass: 80, Marginal: 80}
+	assert.Equal(t, "provider config map validation error: marginalScore has to be less than passScore", metric.basicChecks().Error())
+	metric.Marginal = 60
+	assert.Equal(t, nil, metric.basicChecks())
+	assert.Equal(t, 60, metric.minimumScore())
+
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	providerConfig, err := os.ReadFile(filepath.Join(basePath, "provider/providerConfig"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(basePath, "provider/providerConfig"), append(providerConfig, []byte("\nmarginalScore: 60\n")...), 0644))
+	k8sclient := jobFakeClient(batchv1.JobCondition{})
+	clients := newClients(k8sclient, c)
+	isd := &fakeISD{statuses: []CanaryStatusResponse{canaryStatusResponse(t, `{"canaryResult": {"overallScore": 70}, "status": {"status": "COMPLETED"}}`)}}
+	clients.isd = isd
+	exitCode, err := runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeInconclusive, exitCode)
+	assert.Contains(t, isd.payloads[0], `"canaryHealthCheckHandler":{"minimumCanaryResultScore":"60"}`)
+	lastPatch := k8sclient.Actions()[len(k8sclient.Actions())-1].(kubetesting.PatchAction)
+	assert.Contains(t, string(lastPatch.GetPatch()), "The analysis has Inconclusive")
+
+	status, err := getCanaryStatus(context.TODO(), &fakeISD{statuses: []CanaryStatusResponse{canaryStatusResponse(t, `{"canaryResult": {"overallScore": 70}, "status": {"status": "COMPLETED"}}`)}}, "1424", "", OPSMXMetric{Pass: 80, Marginal: 60})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeInconclusive, status.exitCode())
+}
+
+func TestServiceGates(t *testing.T) {
+	metric := OPSMXMetric{
+		Pass: 80,
+		Services: []OPSMXService{
+			{ServiceName: "frontend"},
+			{ServiceName: "backend", PassScore: 90},
+			{PassScore: 60},
+		},
+	}
+	data := []byte(`{
+		"canaryResult": {"overallScore": 85},
+		"services": [
+			{"serviceName": "frontend", "serviceGate": "gate1", "serviceScore": 70},
+			{"serviceName": "backend", "serviceGate": "gate2", "serviceScore": 88.6},
+			{"serviceGate": "gate3", "serviceScore": "75"}
+		],
+		"status": {"status": "COMPLETED"}}`)
+	result := canaryStatusResponse(t, string(data))
+	failed, err := metric.failedGates(result.Services)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"service backend (gate2) scored 89 below its passScore 90"}, failed)
+
+	metric.Services[1].PassScore = 85
+	failed, err = metric.failedGates(result.Services)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(failed))
+
+	_, err = metric.failedGates(nil)
+	assert.Equal(t, "analysis Error: score of service backend (gate2) not found in the canary Response", err.Error())
+
+	metric.Services[2].PassScore = 101
+	assert.Equal(t, "provider config map validation error: passScore of service3 has to be between 0 and 100", metric.basicCheckErrors()[1].Error())
+
+	//the overall score passes, the critical service fails the analysis
+	metric.Services[1].PassScore = 90
+	metric.Services[2].PassScore = 60
+	status, err := getCanaryStatus(context.TODO(), &fakeISD{statuses: []CanaryStatusResponse{canaryStatusResponse(t, string(data))}}, "1424", "", metric)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "85", status.score)
+	assert.Equal(t, AnalysisPhaseFailed, status.phase)
+}
+
+func TestCanaryResult(t *testing.T) {
+	data := `{
+		"id": "1424",
+		"application": "testapp",
+		"canaryResult": {
+			"canaryReportURL": "https://isd.opsmx.net/report/1424",
+			"overallScore": 72.6,
+			"overallResult": "REVIEW",
+			"intervalNo": 2,
+			"isLastRun": true,
+			"errors": []
+		},
+		"services": [{
+			"serviceName": "backend",
+			"serviceGate": "gate1",
+			"serviceScore": "65",
+			"logAnalysis": {"score": 90, "result": "HEALTHY"},
+			"metricAnalysis": {"score": 40, "result": "UNHEALTHY", "metrics": [
+				{"name": "cpu", "score": 95, "result": "HEALTHY"},
+				{"name": "latency_p99", "score": 12.5, "result": "UNHEALTHY"}
+			]}
+		}],
+		"status": {"complete": true, "status": "COMPLETED"}}`
+	result := canaryStatusResponse(t, data)
+	assert.Equal(t, Score("72.6"), result.CanaryResult.OverallScore)
+	assert.Equal(t, "2", result.CanaryResult.IntervalNo.String())
+	assert.Equal(t, Score("65"), result.Services[0].ServiceScore)
+	assert.Equal(t, Score("12.5"), result.Services[0].MetricAnalysis.Metrics[1].Score)
+	assert.Equal(t, []string{"backend/latency_p99"}, result.Services[0].unhealthyMetrics())
+
+	score, err := result.CanaryResult.OverallScore.value()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 73, score)
+	score, err = Score("").value()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, score)
+	encoded, err := json.Marshal(result.Services[0].MetricAnalysis.Metrics[1])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"name":"latency_p99","score":12.5,"result":"UNHEALTHY"}`, string(encoded))
+
+	status, err := getCanaryStatus(context.TODO(), &fakeISD{statuses: []CanaryStatusResponse{result}}, "1424", "", OPSMXMetric{Pass: 70})
+	assert.Equal(t, nil, err)
+	var out bytes.Buffer
+	status.print(&out)
+	assert.Contains(t, out.String(), "service:   backend (gate1) 65\nunhealthy: backend/latency_p99\n")
+	out.Reset()
+	assert.Equal(t, nil, status.printJSON(&out))
+	var report CanaryReport
+	assert.Equal(t, nil, json.Unmarshal(out.Bytes(), &report))
+	assert.Equal(t, "73", report.Score)
+	assert.Equal(t, AnalysisPhaseSuccessful, report.Phase)
+	assert.Equal(t, []string{"backend/latency_p99"}, report.UnhealthyMetrics)
+	assert.Equal(t, result.Services, report.Services)
+}
+
+func TestIntervalScores(t *testing.T) {
+	k8sclient := jobFakeClient(batchv1.JobCondition{})
+	clients := newClients(k8sclient, http.Client{})
+	cd := CanaryDetails{jobName: "jobname-123", canaryId: "1424", reportUrl: "https://isd.opsmx.net/report/1424"}
+	running := func(intervalNo string, score string) CanaryStatusResponse {
+		return canaryStatusResponse(t, fmt.Sprintf(`{"canaryResult": {"intervalNo": %s, "overallScore": %s}, "status": {"status": "RUNNING"}}`, intervalNo, score))
+	}
+
+	patchIntervalScore(context.TODO(), clients, cd, "1", 73)
+	patch := string(k8sclient.Actions()[len(k8sclient.Actions())-1].(kubetesting.PatchAction).GetPatch())
+	assert.Contains(t, patch, `"type":"OpsmxInterval"`)
+	assert.Contains(t, patch, "lastProbeTime")
+	var jobStatus JobStatus
+	assert.Equal(t, nil, json.Unmarshal([]byte(patch), &jobStatus))
+	interval, err := analysis.ParseInterval((*jobStatus.Status.Conditions)[0].Message)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1", interval.IntervalNo)
+	assert.Equal(t, "73", interval.Score)
+	assert.Equal(t, "https://isd.opsmx.net/report/1424", interval.ReportUrl)
+	assert.NotNil(t, interval.ScoredAt)
+
+	//an interval is only scored once, and not before ISD has scored it
+	intervalNo, score, scored := running("1", "72.6").newIntervalScore("")
+	assert.Equal(t, "1", intervalNo)
+	assert.Equal(t, 73, score)
+	assert.Equal(t, true, scored)
+	_, _, scored = running("1", "72.6").newIntervalScore("1")
+	assert.Equal(t, false, scored)
+	intervalNo, _, scored = running("2", "null").newIntervalScore("1")
+	assert.Equal(t, "1", intervalNo)
+	assert.Equal(t, false, scored)
+
+	//the first poll of an interval analysis is at the end of its first interval
+	metric := OPSMXMetric{LifetimeMinutes: 30, Delay: 5, IntervalTime: 10, CanaryStartTime: "1682935200000"}
+	assert.Equal(t, time.UnixMilli(1682935200000).Add(15*time.Minute), metric.firstScoreAt())
+	metric.IntervalTime = 0
+	assert.Equal(t, metric.windowEnd(), metric.firstScoreAt())
+}
+
+func TestAbortBelowScore(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	basePath := setupConfigDir(t, "testcases/analysis/abortBelowScore")
+	k8sclient := jobFakeClient(batchv1.JobCondition{})
+	clients := newClients(k8sclient, c)
+	isd := &fakeISD{statuses: []CanaryStatusResponse{
+		canaryStatusResponse(t, `{"canaryResult": {}, "status": {"status": "RUNNING"}}`),
+		canaryStatusResponse(t, `{"canaryResult": {"intervalNo": 1, "overallScore": 90}, "status": {"status": "RUNNING"}}`),
+		canaryStatusResponse(t, `{"canaryResult": {"intervalNo": 2, "overallScore": 30}, "status": {"status": "RUNNING"}}`),
+		canaryStatusResponse(t, `{"canaryResult": {"intervalNo": 3, "overallScore": 90}, "status": {"status": "COMPLETED"}}`),
+	}}
+	clients.isd = isd
+
+	//the canary is cancelled as soon as an interval scores below abortBelowScore
+	exitCode, err := runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeFailed, exitCode)
+	assert.Equal(t, []string{"1424"}, isd.cancelled)
+	lastPatch := k8sclient.Actions()[len(k8sclient.Actions())-1].(kubetesting.PatchAction)
+	assert.Contains(t, string(lastPatch.GetPatch()), "The analysis has aborted early, interval 2 scored 30 below abortBelowScore 40")
+
+	metric := OPSMXMetric{LifetimeMinutes: 30, Pass: 80, AbortBelow: 90, IntervalTime: 5}
+	assert.Equal(t, "provider config map validation error: abortBelowScore cannot be more than passScore", metric.basicChecks().Error())
+	metric = OPSMXMetric{LifetimeMinutes: 30, Pass: 80, AbortBelow: 40}
+	assert.Equal(t, "provider config map validation error: intervalTime should be given along with abortBelowScore to abort on interval scores", metric.basicChecks().Error())
+}
+
+func TestEvents(t *testing.T) {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jobname-123",
+			Namespace: defaults.Namespace(),
+			UID:       "job-uid",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "argoproj.io/v1alpha1",
+				Kind:       "AnalysisRun",
+				Name:       "rollout-analysis-1",
+				UID:        "analysisrun-uid",
+			}},
+		},
+	}
+	k8sclient := k8sfake.NewSimpleClientset(job)
+	clients := newClients(k8sclient, http.Client{})
+	cd := CanaryDetails{jobName: "jobname-123", canaryId: "1424", reportUrl: "https://isd.opsmx.net/report/1424", value: "73", phase: AnalysisPhaseFailed}
+
+	//the event is recorded on the Job and on the AnalysisRun owning it
+	clients.recordAnalysisCompleted(context.TODO(), cd, "service backend (gate1) scored 65 below its passScore 90")
+	events, err := k8sclient.CoreV1().Events(defaults.Namespace()).List(context.TODO(), metav1.ListOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(events.Items))
+	var objects []string
+	for _, event := range events.Items {
+		objects = append(objects, fmt.Sprintf("%s/%s/%s", event.InvolvedObject.Kind, event.InvolvedObject.Name, event.InvolvedObject.UID))
+		assert.Equal(t, corev1.EventTypeWarning, event.Type)
+		assert.Equal(t, EventReasonAnalysisCompleted, event.Reason)
+		assert.Equal(t, "the analysis is Failed with score 73: service backend (gate1) scored 65 below its passScore 90, canary ID 1424, report URL https://isd.opsmx.net/report/1424", event.Message)
+	}
+	assert.ElementsMatch(t, []string{"Job/jobname-123/job-uid", "AnalysisRun/rollout-analysis-1/analysisrun-uid"}, objects)
+
+	//recording an event does not fail the analysis, without the Job or without kubernetes it is only logged
+	clients.recordEvent(context.TODO(), CanaryDetails{jobName: "other"}, corev1.EventTypeNormal, EventReasonConfigValidated, "provider config and opsmx profile secret validated")
+	newClients(nil, http.Client{}).recordEvent(context.TODO(), cd, corev1.EventTypeNormal, EventReasonIntervalScored, "interval 1 scored 73")
+	events, _ = k8sclient.CoreV1().Events(defaults.Namespace()).List(context.TODO(), metav1.ListOptions{})
+	assert.Equal(t, 2, len(events.Items))
+}
+
+func TestRunAnalysisEvents(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jobname-123",
+			Namespace: defaults.Namespace(),
+		},
+	}
+	k8sclient := k8sfake.NewSimpleClientset(job)
+	clients := newClients(k8sclient, c)
+	clients.isd = &fakeISD{statuses: []CanaryStatusResponse{
+		canaryStatusResponse(t, `{"canaryResult": {"canaryReportURL": "https://isd.opsmx.net/report/1424", "overallScore": 90}, "status": {"status": "COMPLETED"}}`),
+	}}
+	basePath := setupConfigDir(t, "testcases/analysis/providerConfig")
+	exitCode, err := runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeSuccess, exitCode)
+
+	events, err := k8sclient.CoreV1().Events(defaults.Namespace()).List(context.TODO(), metav1.ListOptions{})
+	assert.Equal(t, nil, err)
+	var reasons []string
+	for _, event := range events.Items {
+		reasons = append(reasons, event.Reason)
+	}
+	assert.ElementsMatch(t, []string{EventReasonConfigValidated, EventReasonCanaryRegistered, EventReasonAnalysisCompleted}, reasons)
+
+	//the Job is read once to resume a registered canary and once for the owners of all the events of the run
+	gets := 0
+	for _, action := range k8sclient.Actions() {
+		if action.Matches("get", "jobs") {
+			gets++
+		}
+	}
+	assert.Equal(t, 2, gets)
+}
+
+func TestAnnotateOwners(t *testing.T) {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "jobname-123",
+			Namespace:       defaults.Namespace(),
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "argoproj.io/v1alpha1", Kind: "AnalysisRun", Name: "rollout-analysis-1"}},
+		},
+	}
+	analysisRun := &v1alpha1.AnalysisRun{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "rollout-analysis-1",
+			Namespace:       defaults.Namespace(),
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout", Name: "rollout"}},
+		},
+	}
+	rollout := &v1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "rollout",
+			Namespace:   defaults.Namespace(),
+			Annotations: map[string]string{"rollout.argoproj.io/revision": "2", "opsmx.io/score": "40"},
+		},
+	}
+	argoclient := argofake.NewSimpleClientset(analysisRun, rollout)
+	k8sclient := k8sfake.NewSimpleClientset(job)
+	clients := newClients(k8sclient, http.Client{})
+	clients.argoclientset = argoclient
+	cd := CanaryDetails{jobName: "jobname-123", canaryId: "1424", reportUrl: "https://isd.opsmx.net/report/1424"}
+
+	clients.annotateOwners(context.TODO(), cd)
+	//the score of the previous analysis of the Rollout is removed when the new canary is registered
+	annotated, err := argoclient.ArgoprojV1alpha1().Rollouts(defaults.Namespace()).Get(context.TODO(), "rollout", metav1.GetOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]string{
+		"rollout.argoproj.io/revision": "2",
+		"opsmx.io/canary-id":           "1424",
+		"opsmx.io/report-url":          "https://isd.opsmx.net/report/1424",
+	}, annotated.Annotations)
+
+	//the score is added once the canary is scored
+	cd.value = "90"
+	clients.annotateOwners(context.TODO(), cd)
+
+	//the owners are read once for all the annotations of the run
+	assert.Equal(t, 1, len(k8sclient.Actions()))
+	reads := 0
+	for _, action := range argoclient.Actions() {
+		if action.Matches("get", "analysisruns") {
+			reads++
+		}
+	}
+	assert.Equal(t, 1, reads)
+	annotatedRun, err := argoclient.ArgoprojV1alpha1().AnalysisRuns(defaults.Namespace()).Get(context.TODO(), "rollout-analysis-1", metav1.GetOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "90", annotatedRun.Annotations["opsmx.io/score"])
+	annotated, _ = argoclient.ArgoprojV1alpha1().Rollouts(defaults.Namespace()).Get(context.TODO(), "rollout", metav1.GetOptions{})
+	assert.Equal(t, "90", annotated.Annotations["opsmx.io/score"])
+
+	//without the permission to patch the Rollout the analysis goes on, the AnalysisRun is still annotated
+	argoclient = argofake.NewSimpleClientset(analysisRun, rollout)
+	argoclient.PrependReactor("patch", "rollouts", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}, "rollout", errors.New("no RBAC policy matched"))
+	})
+	clients.argoclientset = argoclient
+	clients.annotateOwners(context.TODO(), cd)
+	annotatedRun, _ = argoclient.ArgoprojV1alpha1().AnalysisRuns(defaults.Namespace()).Get(context.TODO(), "rollout-analysis-1", metav1.GetOptions{})
+	assert.Equal(t, "1424", annotatedRun.Annotations["opsmx.io/canary-id"])
+	annotated, _ = argoclient.ArgoprojV1alpha1().Rollouts(defaults.Namespace()).Get(context.TODO(), "rollout", metav1.GetOptions{})
+	assert.Equal(t, "", annotated.Annotations["opsmx.io/canary-id"])
+}
+
+func TestRunAnalysisResumeRunning(t *testing.T) {
+	os.Setenv("STABLE_POD_HASH", "baseline")
+	os.Setenv("LATEST_POD_HASH", "canary")
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	//the previous pod was evicted once the window of lifetimeMinutes was over, within the grace period
+	message, err := CanaryDetails{user: "admin", canaryId: "1424", ReportId: "token-123", registeredAt: time.Now().Add(-5 * time.Minute)}.message()
+	assert.Equal(t, nil, err)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "jobname-123",
+			Namespace: defaults.Namespace(),
+		},
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{{Message: message, Type: "OpsmxAnalysis", Status: "True"}},
+		},
+	}
+	isd := &fakeISD{statuses: []CanaryStatusResponse{
+		canaryStatusResponse(t, `{"canaryResult": {}, "status": {"status": "RUNNING"}}`),
+		canaryStatusResponse(t, `{"canaryResult": {"overallScore": 90}, "status": {"status": "COMPLETED"}}`),
+	}}
+	clients := newClients(k8sfake.NewSimpleClientset(job), c)
+	clients.isd = isd
+	basePath := setupConfigDir(t, "testcases/analysis/pollInterval")
+
+	//the window is counted from the registration of the canary, the next poll is not pushed past the restart
+	done := make(chan ExitCode)
+	go func() {
+		exitCode, err := runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+		assert.Equal(t, nil, err)
+		done <- exitCode
+	}()
+	select {
+	case exitCode := <-done:
+		assert.Equal(t, ReturnCodeSuccess, exitCode)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the resumed analysis waited for a new window before polling")
+	}
+	assert.Equal(t, 0, len(isd.payloads))
+
+	//the deadline of a resumed canary does not restart with the pod either
+	message, err = CanaryDetails{user: "admin", canaryId: "1424", ReportId: "token-123", registeredAt: time.Now().Add(-10 * time.Minute)}.message()
+	assert.Equal(t, nil, err)
+	job.Status.Conditions[0].Message = message
+	isd = &fakeISD{statuses: []CanaryStatusResponse{canaryStatusResponse(t, `{"canaryResult": {}, "status": {"status": "RUNNING"}}`)}}
+	clients = newClients(k8sfake.NewSimpleClientset(job), c)
+	clients.isd = isd
+	exitCode, err := runAnalysis(context.TODO(), clients, ResourceNames{jobName: "jobname-123"}, newConfigPaths(basePath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ReturnCodeInconclusive, exitCode)
+	assert.Equal(t, []string{"1424"}, isd.cancelled)
+}
+
+func TestConfigDurations(t *testing.T) {
+	//a bare number is a number of seconds, as written in the JSON configs of the plugin and the server
+	var metric OPSMXMetric
+	err := yaml.Unmarshal([]byte(`{"poll": {"interval": 30, "maxInterval": "2m", "backoff": 2}, "retry": {"attempts": 2, "baseDelay": 0.5, "maxDelay": "10"}, "deadline": {"gracePeriod": "90s"}}`), &metric)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, PollPolicy{Interval: 30 * time.Second, MaxInterval: 2 * time.Minute, Backoff: 2}, metric.Poll)
+	assert.Equal(t, RetryPolicy{Attempts: 2, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}, metric.Retry)
+	assert.Equal(t, 90*time.Second, metric.Deadline.GracePeriod)
+
+	err = yaml.Unmarshal([]byte("poll:\n  interval: soon\n"), &metric)
+	assert.Equal(t, `invalid duration "soon", expected a number of seconds or a duration such as 30s`, err.Error())
+}
+
+func TestRetryNonIdempotent(t *testing.T) {
+	var attempts int
+	var failure error
+	c := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, failure
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewBufferString(`{"canaryId": 1424}`)),
+			Header:     make(http.Header),
+		}, nil
+	})
+	secretData := map[string]string{"opsmxIsdUrl": "https://opsmx.test.tst", "user": "admin"}
+	isd := newISDClient(c, secretData, RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond})
+
+	//ISD may have registered the canary before the response was lost, a retry would register a second one
+	failure = &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	_, err := isd.RegisterCanary(context.TODO(), RegisterCanaryRequest{Payload: `{}`})
+	assert.Contains(t, err.Error(), "i/o timeout")
+	assert.Equal(t, 1, attempts)
+
+	//a connection that could not be made did not reach ISD
+	attempts = 0
+	failure = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	canary, err := isd.RegisterCanary(context.TODO(), RegisterCanaryRequest{Payload: `{}`})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1424", canary.CanaryId.String())
+	assert.Equal(t, 2, attempts)
+
+	post := retryableFor(http.MethodPost)
+	assert.Equal(t, true, post(&ISDResponseError{StatusCode: 503, RetryAfter: time.Second}))
+	assert.Equal(t, false, post(&ISDResponseError{StatusCode: 503}))
+	assert.Equal(t, false, post(&ISDResponseError{StatusCode: 502, RetryAfter: time.Second}))
+	assert.Equal(t, true, retryableFor(http.MethodGet)(&ISDResponseError{StatusCode: 502}))
+}
+
+func TestCanaryIdOfReportToken(t *testing.T) {
+	message, err := CanaryDetails{user: "admin", canaryId: "1424", ReportId: "token-123"}.message()
+	assert.Equal(t, nil, err)
+	jobs := []runtime.Object{
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "failed-job", Namespace: defaults.Namespace()},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: "OpsmxAnalysis", Status: "True", Message: "analysis Error: POST /autopilot/api/v5/registerCanary returned 500 Internal Server Error"},
+			}},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy-job", Namespace: defaults.Namespace()},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: "OpsmxAnalysis", Status: "True", Message: "analysisDetails\n user: admin\n canaryID: 1200\n reportURL: https://isd.opsmx.net/report/1200\n reportId: token-100"},
+			}},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "jobname-123", Namespace: defaults.Namespace()},
+			Status:     batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: "OpsmxAnalysis", Status: "True", Message: message}}},
+		},
+	}
+	k8sclient := k8sfake.NewSimpleClientset(jobs...)
+
+	canaryId, err := canaryIdOfReportToken(context.TODO(), k8sclient, "token-123")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1424", canaryId)
+	canaryId, err = canaryIdOfReportToken(context.TODO(), k8sclient, "token-100")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1200", canaryId)
+	_, err = canaryIdOfReportToken(context.TODO(), k8sclient, "token-999")
+	assert.Equal(t, fmt.Sprintf("analysis Error: no analysis Job of namespace %s carries the report token", defaults.Namespace()), err.Error())
+}
+
+func TestStatusCommandErrors(t *testing.T) {
+	var out, errOut bytes.Buffer
+	exitCode := statusCommand([]string{"--output", "json", "--secrets-dir", t.TempDir(), "1424"}, &out, &errOut)
+	assert.Equal(t, int(ReturnCodeError), exitCode)
+	assert.Equal(t, "", out.String())
+	assert.Contains(t, errOut.String(), "opsmxIsdUrl")
 }
@@ -2,11 +2,21 @@ package main
 
 import (
 	"context"
+	"flag"
+	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
+	argoclientset "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	rest "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func init() {
@@ -15,6 +25,8 @@ func init() {
 	})
 	log.SetLevel(log.InfoLevel)
 	log.SetLevel(log.DebugLevel)
+	//jitter of the retries
+	rand.Seed(time.Now().UnixNano())
 }
 
 func newClients(kubeclientset kubernetes.Interface, client http.Client) *Clients {
@@ -24,6 +36,22 @@ func newClients(kubeclientset kubernetes.Interface, client http.Client) *Clients
 	}
 }
 
+// Return the paths of the provider config, templates and secrets mounted under basePath
+func newConfigPaths(basePath string) ConfigPaths {
+	return ConfigPaths{
+		providerConfig: filepath.Join(basePath, "provider/providerConfig"),
+		templates:      filepath.Join(basePath, "templates"),
+		secrets:        filepath.Join(basePath, "secrets"),
+	}
+}
+
+func getEnvOrDefault(key string, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
 func NewHttpClient() http.Client {
 	c := http.Client{
 		Timeout: httpConnectionTimeout,
@@ -31,17 +59,60 @@ func NewHttpClient() http.Client {
 	return c
 }
 
-func runner(c *Clients) error {
-	basePath := "/etc/config/"
-	resourceNames, err := checkPatchabilityReturnResources(c)
-	if err != nil {
-		return err
+// Build the rest config from the in-cluster config, or from a kubeconfig when running outside the cluster
+func newRestConfig(kubeconfig string, kubeContext string, namespace string) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" && kubeContext == "" {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfig
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+		config, err = clientConfig.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		if namespace == "" {
+			namespace, _, err = clientConfig.Namespace()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	//the namespace of the Job is resolved through POD_NAMESPACE everywhere else
+	if namespace != "" {
+		os.Setenv("POD_NAMESPACE", namespace)
+	}
+	return config, nil
+}
+
+func runner(ctx context.Context, c *Clients, opts RunOptions) error {
+	resourceNames := ResourceNames{
+		jobName: opts.jobName,
+	}
+	if c.kubeclientset != nil {
+		var err error
+		resourceNames, err = checkPatchabilityReturnResources(ctx, c, opts.jobName)
+		if err != nil {
+			return err
+		}
 	}
 	log.Info("starting the runAnalysis function")
-	errcode, errrun := runAnalysis(c, resourceNames, basePath)
+	errcode, errrun := runAnalysis(ctx, c, resourceNames, opts.paths)
 	if errrun != nil {
 		errMsg := errrun.Error()
-		err := patchJobError(context.TODO(), c.kubeclientset, resourceNames.jobName, errMsg)
+		//the run context may be done already, the error is patched with a fresh one
+		patchCtx, cancel := finalContext()
+		defer cancel()
+		//the canary details are read before the error condition replaces them, and kept in it
+		cd := getRegisteredCanary(patchCtx, c, resourceNames)
+		cd.jobName = resourceNames.jobName
+		c.recordEvent(patchCtx, cd, corev1.EventTypeWarning, EventReasonAnalysisError, truncateBody([]byte(errMsg)))
+		err := patchJobError(patchCtx, c.kubeclientset, cd, errrun)
 		if err != nil {
 			log.Error("an error occurred while patching the error from run analysis")
 			return err
@@ -56,17 +127,65 @@ func runner(c *Clients) error {
 }
 
 func main() {
-	config, err := rest.InClusterConfig()
-	checkError(err)
+	//Argo Rollouts starts metric provider plugins without arguments and sets the handshake cookie
+	if os.Getenv(pluginHandshake.MagicCookieKey) == pluginHandshake.MagicCookieValue {
+		servePlugin()
+		return
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validateCommand(os.Args[2:], os.Stdout))
+		case "status":
+			os.Exit(statusCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "serve":
+			os.Exit(serveCommand(os.Args[2:]))
+		}
+	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	checkError(err)
+	dryRunMode := flag.Bool("dry-run", false, "render the registerCanary payload and gitops templates without calling ISD")
+	kubeconfig := flag.String("kubeconfig", "", "path to a kubeconfig file to run outside the cluster")
+	kubeContext := flag.String("context", "", "kubeconfig context to use when running outside the cluster")
+	namespace := flag.String("namespace", "", "namespace of the Job, defaults to the namespace of the pod or of the kubeconfig context")
+	jobName := flag.String("job-name", "", "name of the Job to patch, resolved from the pod set in MY_POD_NAME when empty")
+	noK8s := flag.Bool("no-k8s", false, "skip every Kubernetes call and only write the results to stdout")
+	defaultPaths := newConfigPaths(defaultBasePath)
+	providerConfigPath := flag.String("provider-config", getEnvOrDefault("PROVIDER_CONFIG_PATH", defaultPaths.providerConfig), "path of the provider config file, can also be set through PROVIDER_CONFIG_PATH")
+	templatesPath := flag.String("templates-dir", getEnvOrDefault("TEMPLATES_DIR", defaultPaths.templates), "directory of the gitops templates, can also be set through TEMPLATES_DIR")
+	secretsPath := flag.String("secrets-dir", getEnvOrDefault("SECRETS_DIR", defaultPaths.secrets), "directory of the opsmx profile secret, can also be set through SECRETS_DIR")
+	flag.Parse()
+
+	paths := ConfigPaths{
+		providerConfig: *providerConfigPath,
+		templates:      *templatesPath,
+		secrets:        *secretsPath,
+	}
+
+	if *dryRunMode {
+		clients := newClients(nil, NewHttpClient())
+		log.Info("starting the dry run")
+		err := dryRun(clients, paths, os.Stdout)
+		checkError(err)
+		return
+	}
 
 	httpclient := NewHttpClient()
 
-	clients := newClients(clientset, httpclient)
+	clients := newClients(nil, httpclient)
+	if !*noK8s {
+		config, err := newRestConfig(*kubeconfig, *kubeContext, *namespace)
+		checkError(err)
+		clients.kubeclientset, err = kubernetes.NewForConfig(config)
+		checkError(err)
+		clients.argoclientset, err = argoclientset.NewForConfig(config)
+		checkError(err)
+	}
+
+	//Argo Rollouts deletes the Job when the AnalysisRun is aborted, which sends SIGTERM to the pod
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	log.Info("starting the runner function")
-	err = runner(clients)
+	err := runner(ctx, clients, RunOptions{jobName: *jobName, paths: paths})
 	checkError(err)
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+
+	"github.com/argoproj/argo-rollouts/utils/defaults"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// JobOwners are the Job of the analysis, the AnalysisRun owning it and the Rollout owning the AnalysisRun, nil when
+// they are not known
+type JobOwners struct {
+	jobName     string
+	job         *corev1.ObjectReference
+	analysisRun *corev1.ObjectReference
+	rollout     *corev1.ObjectReference
+}
+
+// Owners of the Job, read once and kept for the rest of the run. Owners that cannot be read are not read again,
+// the events of the run are then only logged and the owners are not annotated.
+func (c *Clients) jobOwners(ctx context.Context, jobName string) JobOwners {
+	if c.owners != nil && c.owners.jobName == jobName {
+		return *c.owners
+	}
+	owners := JobOwners{jobName: jobName}
+	c.owners = &owners
+	job, err := c.kubeclientset.BatchV1().Jobs(defaults.Namespace()).Get(ctx, jobName, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("could not read the Job %s, its events are only logged and its owners are not annotated: %v", jobName, err)
+		return owners
+	}
+	owners.job = &corev1.ObjectReference{
+		APIVersion:      "batch/v1",
+		Kind:            "Job",
+		Namespace:       job.Namespace,
+		Name:            job.Name,
+		UID:             job.UID,
+		ResourceVersion: job.ResourceVersion,
+	}
+	for _, owner := range job.OwnerReferences {
+		if owner.Kind == "AnalysisRun" {
+			owners.analysisRun = &corev1.ObjectReference{
+				APIVersion: owner.APIVersion,
+				Kind:       owner.Kind,
+				Namespace:  job.Namespace,
+				Name:       owner.Name,
+				UID:        owner.UID,
+			}
+		}
+	}
+	//the Rollout is only needed for the annotations, an AnalysisRun may also be owned by an Experiment
+	if owners.analysisRun == nil || c.argoclientset == nil {
+		return owners
+	}
+	analysisRun, err := c.argoclientset.ArgoprojV1alpha1().AnalysisRuns(job.Namespace).Get(ctx, owners.analysisRun.Name, metav1.GetOptions{})
+	if err != nil {
+		logAnnotationError("AnalysisRun", owners.analysisRun.Name, err)
+		return owners
+	}
+	for _, owner := range analysisRun.OwnerReferences {
+		if owner.Kind == "Rollout" {
+			owners.rollout = &corev1.ObjectReference{
+				APIVersion: owner.APIVersion,
+				Kind:       owner.Kind,
+				Namespace:  job.Namespace,
+				Name:       owner.Name,
+				UID:        owner.UID,
+			}
+		}
+	}
+	return owners
+}
+
+// Objects the events of the Job are recorded on, the Job and the AnalysisRun owning it
+func (o JobOwners) eventObjects() []corev1.ObjectReference {
+	var objects []corev1.ObjectReference
+	for _, object := range []*corev1.ObjectReference{o.job, o.analysisRun} {
+		if object != nil {
+			objects = append(objects, *object)
+		}
+	}
+	return objects
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/argoproj/argo-rollouts/utils/defaults"
+	"github.com/opsmx/argo-metricprovider-job/analysis"
 	log "github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -16,20 +19,52 @@ import (
 //TODO -Retrieve the previous state?
 //TODO - Rethink error
 
-func patchJobCanaryDetails(ctx context.Context, kubeclient kubernetes.Interface, cd CanaryDetails) error {
+// Versioned document of the OpsmxAnalysis condition, read by the analysis package
+func (cd CanaryDetails) message() (string, error) {
+	now := time.Now().UTC()
+	details := analysis.Details{
+		User:      cd.user,
+		CanaryId:  cd.canaryId,
+		ReportUrl: cd.reportUrl,
+		ReportId:  cd.ReportId,
+		Score:     cd.value,
+		Phase:     cd.phase,
+		UpdatedAt: &now,
+		Error:     cd.errorMessage,
+	}
+	if !cd.registeredAt.IsZero() {
+		registeredAt := cd.registeredAt.UTC()
+		details.RegisteredAt = &registeredAt
+	}
+	for _, service := range cd.services {
+		details.Services = append(details.Services, analysis.Service{
+			Name:             service.ServiceName,
+			Gate:             service.ServiceGate,
+			Score:            string(service.ServiceScore),
+			UnhealthyMetrics: service.unhealthyMetrics(),
+		})
+	}
+	return details.Message()
+}
 
+func patchJobCanaryDetails(ctx context.Context, kubeclient kubernetes.Interface, cd CanaryDetails) error {
+	cd.phase = AnalysisPhaseRunning
+	message, err := cd.message()
+	if err != nil {
+		return err
+	}
 	jobStatus := JobStatus{
 		Status: Status{
 			Conditions: &[]Conditions{{
-				Message:       fmt.Sprintf("analysisDetails\n user: %s\n canaryID: %s\n reportURL: %s\n reportId: %s", cd.user, cd.canaryId, cd.reportUrl, cd.ReportId),
-				Type:          "OpsmxAnalysis",
+				Message:       message,
+				Type:          analysis.ConditionType,
 				LastProbeTime: metav1.NewTime(time.Now()),
 				Status:        "True",
 			},
 			},
 		},
 	}
-	err := patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
+	err = patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
 	if err != nil {
 		return err
 	}
@@ -39,19 +74,23 @@ func patchJobCanaryDetails(ctx context.Context, kubeclient kubernetes.Interface,
 }
 
 func patchJobSuccessful(ctx context.Context, kubeclient kubernetes.Interface, cd CanaryDetails) error {
-
+	cd.phase = AnalysisPhaseSuccessful
+	message, err := cd.message()
+	if err != nil {
+		return err
+	}
 	jobStatus := JobStatus{
 		Status: Status{
 			Conditions: &[]Conditions{{
-				Message:       fmt.Sprintf("analysisDetails\n user: %s\n canaryID: %s\n reportURL: %s\n reportId: %s\n score: %s", cd.user, cd.canaryId, cd.reportUrl, cd.ReportId, cd.value),
-				Type:          "OpsmxAnalysis",
+				Message:       message,
+				Type:          analysis.ConditionType,
 				LastProbeTime: metav1.NewTime(time.Now()),
 				Status:        "True",
 			},
 			},
 		},
 	}
-	err := patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
+	err = patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
 	if err != nil {
 		return err
 	}
@@ -59,19 +98,51 @@ func patchJobSuccessful(ctx context.Context, kubeclient kubernetes.Interface, cd
 	return nil
 }
 
+// The interval scores go to their own condition, the OpsmxAnalysis condition is read back by a restarted pod
+func patchJobIntervalScore(ctx context.Context, kubeclient kubernetes.Interface, cd CanaryDetails, intervalNo string) error {
+	now := time.Now().UTC()
+	message, err := analysis.Interval{
+		CanaryId:   cd.canaryId,
+		ReportUrl:  cd.reportUrl,
+		IntervalNo: intervalNo,
+		Score:      cd.value,
+		ScoredAt:   &now,
+	}.Message()
+	if err != nil {
+		return err
+	}
+	jobStatus := JobStatus{
+		Status: Status{
+			Conditions: &[]Conditions{{
+				Message:       message,
+				Type:          analysis.IntervalConditionType,
+				LastProbeTime: metav1.NewTime(now),
+				Status:        "True",
+			},
+			},
+		},
+	}
+	return patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
+}
+
+// The phase of cd tells a Failed analysis from an Inconclusive one, the Job fails with the given reason for both
 func patchJobFailedInconclusive(ctx context.Context, kubeclient kubernetes.Interface, reason string, cd CanaryDetails) error {
+	message, err := cd.message()
+	if err != nil {
+		return err
+	}
 	jobStatus := JobStatus{
 		Status: Status{
 			Conditions: &[]Conditions{{
-				Message:       fmt.Sprintf("analysisDetails\n user: %s\n canaryID: %s\n reportURL: %s\n reportId: %s\n score: %s", cd.user, cd.canaryId, cd.reportUrl, cd.ReportId, cd.value),
-				Type:          "OpsmxAnalysis",
+				Message:       message,
+				Type:          analysis.ConditionType,
 				LastProbeTime: metav1.NewTime(time.Now()),
 				Status:        "True",
 			},
 			},
 		},
 	}
-	err := patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
+	err = patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
 	if err != nil {
 		return err
 	}
@@ -92,19 +163,46 @@ func patchJobCancelled(ctx context.Context, kubeclient kubernetes.Interface, job
 	return nil
 }
 
-func patchJobError(ctx context.Context, kubeclient kubernetes.Interface, jobName string, errMsg string) error {
+// Reason of the error condition, tells an authentication failure from a rejected request, an ISD outage
+// or an analysis that ran past its deadline
+func errorReason(err error) string {
+	if errors.Is(err, errAnalysisDeadlineExceeded) {
+		return "DeadlineExceeded"
+	}
+	var responseErr *ISDResponseError
+	if !errors.As(err, &responseErr) {
+		return ""
+	}
+	switch {
+	case responseErr.StatusCode == http.StatusUnauthorized || responseErr.StatusCode == http.StatusForbidden:
+		return "ISDAuthenticationFailed"
+	case responseErr.StatusCode >= 500:
+		return "ISDServerError"
+	}
+	return "ISDRequestRejected"
+}
+
+// Patch the error the analysis of cd ended with, along with the canary when it was registered
+func patchJobError(ctx context.Context, kubeclient kubernetes.Interface, cd CanaryDetails, analysisErr error) error {
+	cd.phase = AnalysisPhaseError
+	cd.errorMessage = analysisErr.Error()
+	message, err := cd.message()
+	if err != nil {
+		return err
+	}
 	jobStatus := JobStatus{
 		Status: Status{
 			Conditions: &[]Conditions{{
-				Message:       errMsg,
-				Type:          "OpsmxAnalysis",
+				Message:       message,
+				Reason:        errorReason(analysisErr),
+				Type:          analysis.ConditionType,
 				LastProbeTime: metav1.NewTime(time.Now()),
 				Status:        "True",
 			},
 			},
 		},
 	}
-	err := patchToJob(ctx, kubeclient, jobStatus, jobName)
+	err = patchToJob(ctx, kubeclient, jobStatus, cd.jobName)
 	if err != nil {
 		return err
 	}
@@ -136,6 +234,12 @@ func patchToJob(ctx context.Context, kubeclient kubernetes.Interface, jobData Jo
 		return err
 	}
 
+	//without kubernetes the status is only written to stdout
+	if kubeclient == nil {
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
 	_, err = kubeclient.BatchV1().Jobs(defaults.Namespace()).Patch(ctx, jobName, types.StrategicMergePatchType, jsonData, metav1.PatchOptions{}, "status")
 	if err != nil {
 		return err
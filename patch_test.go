@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/opsmx/argo-metricprovider-job/analysis"
 	"github.com/stretchr/testify/assert"
 	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -142,6 +145,48 @@ func TestPatchJobError(t *testing.T) {
 		Status:        "True",
 	}
 	k8sclient := jobFakeClient(cond)
-	err := patchJobError(context.TODO(), k8sclient, "jobname-123", "the error message")
+	err := patchJobError(context.TODO(), k8sclient, CanaryDetails{jobName: "jobname-123"}, errors.New("the error message"))
+	assert.Equal(t, nil, err)
+
+	responseErr := &ISDResponseError{
+		Method:     "POST",
+		Path:       "/autopilot/api/v5/registerCanary",
+		StatusCode: 401,
+		Status:     "401 Unauthorized",
+		Body:       `{"message": "invalid token"}`,
+	}
+	cd := CanaryDetails{jobName: "jobname-123", canaryId: "1424", reportUrl: "https://isd.opsmx.net/report/1424", ReportId: "token-123"}
+	err = patchJobError(context.TODO(), k8sclient, cd, fmt.Errorf("getting the canary status: %w", responseErr))
+	assert.Equal(t, nil, err)
+	patch := k8sclient.Actions()[len(k8sclient.Actions())-1].(kubetesting.PatchAction).GetPatch()
+	var jobStatus JobStatus
+	assert.Equal(t, nil, json.Unmarshal(patch, &jobStatus))
+	condition := (*jobStatus.Status.Conditions)[0]
+	assert.Equal(t, "ISDAuthenticationFailed", condition.Reason)
+
+	//the canary registered before the error is kept in the condition
+	details, err := analysis.Parse(condition.Message)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, analysis.PhaseError, details.Phase)
+	assert.Equal(t, "1424", details.CanaryId)
+	assert.Equal(t, "https://isd.opsmx.net/report/1424", details.ReportUrl)
+	assert.Equal(t, `getting the canary status: analysis Error: POST /autopilot/api/v5/registerCanary returned 401 Unauthorized: {"message": "invalid token"}`, details.Error)
+	assert.Equal(t, "", errorReason(errors.New("the error message")))
+	responseErr.StatusCode = 400
+	assert.Equal(t, "ISDRequestRejected", errorReason(responseErr))
+	responseErr.StatusCode = 500
+	assert.Equal(t, "ISDServerError", errorReason(responseErr))
+}
+
+func TestPatchJobWithoutKubernetes(t *testing.T) {
+	cd := CanaryDetails{
+		jobName:   "jobname-123",
+		canaryId:  "123",
+		reportUrl: "https://opsmx.test.tst/reporturl/123",
+		value:     "98",
+	}
+	err := patchJobSuccessful(context.TODO(), nil, cd)
+	assert.Equal(t, nil, err)
+	err = patchJobCancelled(context.TODO(), nil, "jobname-123")
 	assert.Equal(t, nil, err)
 }
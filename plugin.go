@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/argoproj/argo-rollouts/metricproviders/plugin/rpc"
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	metricutil "github.com/argoproj/argo-rollouts/utils/metric"
+	"github.com/argoproj/argo-rollouts/utils/plugin/types"
+	timeutil "github.com/argoproj/argo-rollouts/utils/time"
+	goPlugin "github.com/hashicorp/go-plugin"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	pluginProviderType  = "RPCPlugin"
+	argoCDInstanceLabel = "argocd.argoproj.io/instance"
+)
+
+// handshake expected by the Argo Rollouts controller from a metric provider plugin
+var pluginHandshake = goPlugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "ARGO_ROLLOUTS_RPC_PLUGIN",
+	MagicCookieValue: "metricprovider",
+}
+
+// RpcPlugin runs the ISD analysis as an Argo Rollouts metric provider plugin and reports the
+// score on the AnalysisRun measurements instead of patching a Job
+type RpcPlugin struct {
+	clients *Clients
+	paths   ConfigPaths
+}
+
+var _ rpc.MetricProviderPlugin = &RpcPlugin{}
+
+func (p *RpcPlugin) InitPlugin() types.RpcError {
+	if err := p.clients.configureTLS(p.paths.secrets); err != nil {
+		return types.RpcError{ErrorString: err.Error()}
+	}
+	return types.RpcError{}
+}
+
+// Read the provider config given in the plugin section of the AnalysisTemplate metric
+func getPluginProviderConfig(ar *v1alpha1.AnalysisRun, metric v1alpha1.Metric) (OPSMXMetric, error) {
+	if len(metric.Provider.Plugin) != 1 {
+		return OPSMXMetric{}, errors.New("provider config map validation error: exactly one plugin config has to be set on the metric provider")
+	}
+	var opsmx OPSMXMetric
+	for _, config := range metric.Provider.Plugin {
+		//the plugin config is json, which yaml.v2 reads as well
+		if err := yaml.Unmarshal(config, &opsmx); err != nil {
+			errorMsg := fmt.Sprintf("provider config map validation error: %v", err)
+			return OPSMXMetric{}, errors.New(errorMsg)
+		}
+	}
+	if opsmx.Application == "" && ar != nil {
+		opsmx.Application = ar.Labels[argoCDInstanceLabel]
+	}
+	if opsmx.Application == "" {
+		return OPSMXMetric{}, errors.New("provider config map validation error: application has to be set in the plugin config or through the argocd.argoproj.io/instance label of the AnalysisRun")
+	}
+	return opsmx, nil
+}
+
+func (p *RpcPlugin) Run(ar *v1alpha1.AnalysisRun, metric v1alpha1.Metric) v1alpha1.Measurement {
+	startTime := timeutil.MetaNow()
+	measurement := v1alpha1.Measurement{
+		StartedAt: &startTime,
+	}
+	opsmx, err := getPluginProviderConfig(ar, metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	if err := opsmx.basicChecks(); err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	secretData, err := opsmx.getDataSecret(p.paths.secrets)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	if err := opsmx.checkISDUrl(context.Background(), p.clients, secretData); err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	if err := opsmx.getTimeVariables(); err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	canaryId, _, urlToken, err := opsmx.registerCanary(context.Background(), p.clients, secretData, p.paths.templates)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	log.Infof("registered canary ID %s for metric %s of AnalysisRun %s", canaryId, metric.Name, ar.Name)
+
+	resumeAt := metav1.NewTime(timeutil.Now().Add(opsmx.Poll.firstWait(opsmx.firstScoreAt())))
+	measurement.Phase = v1alpha1.AnalysisPhaseRunning
+	measurement.ResumeAt = &resumeAt
+	measurement.Metadata = map[string]string{
+		"canaryId": canaryId,
+		"reportId": urlToken,
+	}
+	return measurement
+}
+
+func (p *RpcPlugin) Resume(ar *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	opsmx, err := getPluginProviderConfig(ar, metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	secretData, err := opsmx.getDataSecret(p.paths.secrets)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	canaryId := measurement.Metadata["canaryId"]
+	if canaryId == "" {
+		return metricutil.MarkMeasurementError(measurement, errors.New("analysis Error: canaryId not found in the measurement metadata"))
+	}
+	status, err := getCanaryStatus(context.Background(), p.clients.isdClient(secretData, opsmx.Retry), canaryId, measurement.Metadata["reportId"], opsmx)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	if status.reportUrl != "" {
+		measurement.Metadata["reportUrl"] = status.reportUrl
+	}
+
+	switch {
+	case status.status == canaryStatusRunning:
+		//the measurement does not keep the number of polls, the plugin polls at the interval without backoff
+		resumeAt := metav1.NewTime(timeutil.Now().Add(opsmx.Poll.wait(0)))
+		measurement.ResumeAt = &resumeAt
+		return measurement
+	case status.status == canaryStatusCancelled:
+		errorMsg := fmt.Sprintf("analysis Error: canary ID %s was cancelled in ISD", canaryId)
+		return metricutil.MarkMeasurementError(measurement, errors.New(errorMsg))
+	}
+	finishTime := timeutil.MetaNow()
+	measurement.Phase = v1alpha1.AnalysisPhase(status.phase)
+	measurement.Value = status.score
+	measurement.FinishedAt = &finishTime
+	return measurement
+}
+
+func (p *RpcPlugin) Terminate(ar *v1alpha1.AnalysisRun, metric v1alpha1.Metric, measurement v1alpha1.Measurement) v1alpha1.Measurement {
+	opsmx, err := getPluginProviderConfig(ar, metric)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	secretData, err := opsmx.getDataSecret(p.paths.secrets)
+	if err != nil {
+		return metricutil.MarkMeasurementError(measurement, err)
+	}
+	if canaryId := measurement.Metadata["canaryId"]; canaryId != "" {
+		log.Infof("terminating metric %s, cancelling canary ID %s in ISD", metric.Name, canaryId)
+		if err := opsmx.cancelCanary(context.Background(), p.clients, secretData, canaryId); err != nil {
+			return metricutil.MarkMeasurementError(measurement, err)
+		}
+	}
+	finishTime := timeutil.MetaNow()
+	measurement.Phase = v1alpha1.AnalysisPhaseSuccessful
+	measurement.FinishedAt = &finishTime
+	return measurement
+}
+
+// ISD keeps the canaries, there is nothing to clean up on our side
+func (p *RpcPlugin) GarbageCollect(*v1alpha1.AnalysisRun, v1alpha1.Metric, int) types.RpcError {
+	return types.RpcError{}
+}
+
+func (p *RpcPlugin) Type() string {
+	return pluginProviderType
+}
+
+func (p *RpcPlugin) GetMetadata(metric v1alpha1.Metric) map[string]string {
+	return nil
+}
+
+// Serve the plugin to the Argo Rollouts controller, which starts the binary with the handshake cookie set
+func servePlugin() {
+	defaultPaths := newConfigPaths(defaultBasePath)
+	impl := &RpcPlugin{
+		clients: newClients(nil, NewHttpClient()),
+		paths: ConfigPaths{
+			templates: getEnvOrDefault("TEMPLATES_DIR", defaultPaths.templates),
+			secrets:   getEnvOrDefault("SECRETS_DIR", defaultPaths.secrets),
+		},
+	}
+	//stdout is used by go-plugin for the handshake, keep the logs on stderr
+	log.SetOutput(os.Stderr)
+	goPlugin.Serve(&goPlugin.ServeConfig{
+		HandshakeConfig: pluginHandshake,
+		Plugins: map[string]goPlugin.Plugin{
+			"RpcMetricProviderPlugin": &rpc.RpcMetricProviderPlugin{Impl: impl},
+		},
+	})
+}
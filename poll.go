@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+const defaultPollMaxInterval = 5 * time.Minute
+
+// PollPolicy is how often the score of a running canary is asked from ISD. Polling starts once the
+// analysis window is over, or its first interval for an interval analysis, unless interim results are wanted
+type PollPolicy struct {
+	Interval       time.Duration `yaml:"interval,omitempty"`
+	Backoff        float64       `yaml:"backoff,omitempty"`
+	MaxInterval    time.Duration `yaml:"maxInterval,omitempty"`
+	InterimResults bool          `yaml:"interimResults,omitempty"`
+}
+
+func (p PollPolicy) withDefaults() PollPolicy {
+	if p.Interval == 0 {
+		p.Interval = resumeAfter
+	}
+	if p.Backoff == 0 {
+		p.Backoff = 1
+	}
+	if p.MaxInterval == 0 {
+		p.MaxInterval = defaultPollMaxInterval
+	}
+	if p.MaxInterval < p.Interval {
+		p.MaxInterval = p.Interval
+	}
+	return p
+}
+
+func (p PollPolicy) errors() []error {
+	var errs []error
+	if p.Interval < 0 || p.MaxInterval < 0 {
+		errs = append(errs, errors.New("provider config map validation error: poll interval and maxInterval cannot be negative"))
+	}
+	if p.Backoff != 0 && p.Backoff < 1 {
+		errs = append(errs, errors.New("provider config map validation error: poll backoff cannot be less than 1"))
+	}
+	if p.MaxInterval != 0 && p.MaxInterval < p.Interval {
+		errs = append(errs, errors.New("provider config map validation error: poll maxInterval cannot be less than interval"))
+	}
+	return errs
+}
+
+// Wait before the first poll, the score is only final once the window has ended
+func (p PollPolicy) firstWait(windowEnd time.Time) time.Duration {
+	p = p.withDefaults()
+	if wait := time.Until(windowEnd); !p.InterimResults && wait > p.Interval {
+		return wait
+	}
+	return p.Interval
+}
+
+// Wait after the given number of polls that found the canary still running, grown by backoff up to maxInterval
+func (p PollPolicy) wait(polls int) time.Duration {
+	p = p.withDefaults()
+	wait := float64(p.Interval) * math.Pow(p.Backoff, float64(polls))
+	if wait > float64(p.MaxInterval) {
+		return p.MaxInterval
+	}
+	return time.Duration(wait)
+}
+
+// Start of the analysis window of the canary, getTimeVariables has to be called first
+func (metric *OPSMXMetric) windowStart() time.Time {
+	if ms, err := strconv.ParseInt(metric.CanaryStartTime, 10, 64); err == nil {
+		return time.UnixMilli(ms)
+	}
+	return time.Now()
+}
+
+// End of the analysis window of the canary
+func (metric *OPSMXMetric) windowEnd() time.Time {
+	return metric.windowStart().Add(time.Duration(metric.LifetimeMinutes+metric.Delay) * time.Minute)
+}
+
+// Time from which ISD can have a score, the end of the first interval for an interval analysis
+func (metric *OPSMXMetric) firstScoreAt() time.Time {
+	if metric.IntervalTime == 0 {
+		return metric.windowEnd()
+	}
+	return metric.windowStart().Add(time.Duration(metric.IntervalTime+metric.Delay) * time.Minute)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const canaryResultHealthy = "HEALTHY"
+
+// Score is a score of ISD, which sends them either as numbers or as strings
+type Score string
+
+func (s *Score) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if value == nil {
+		*s = ""
+		return nil
+	}
+	*s = Score(fmt.Sprintf("%v", value))
+	return nil
+}
+
+// Numeric scores are written back as numbers
+func (s Score) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseFloat(string(s), 64); err == nil {
+		return []byte(s), nil
+	}
+	return json.Marshal(string(s))
+}
+
+// Rounded value of the score, 0 when ISD did not send one
+func (s Score) value() (int, error) {
+	score := string(s)
+	if score == "" {
+		return 0, nil
+	}
+	if strings.Contains(score, ".") {
+		floatScore, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int(roundFloat(floatScore, 0)), nil
+	}
+	return strconv.Atoi(score)
+}
+
+type CanaryResultStatus struct {
+	Complete bool   `json:"complete"`
+	Status   string `json:"status"`
+}
+
+// CanaryResult is the overall result of a canary, scored interval by interval for an interval analysis
+type CanaryResult struct {
+	CanaryReportURL string          `json:"canaryReportURL,omitempty"`
+	OverallScore    Score           `json:"overallScore,omitempty"`
+	OverallResult   string          `json:"overallResult,omitempty"`
+	IntervalNo      json.Number     `json:"intervalNo,omitempty"`
+	IsLastRun       bool            `json:"isLastRun,omitempty"`
+	Message         string          `json:"message,omitempty"`
+	LastUpdated     string          `json:"lastUpdated,omitempty"`
+	Errors          json.RawMessage `json:"errors,omitempty"`
+}
+
+// ServiceResult is the score of a service of the serviceList, under the gate it was registered with
+type ServiceResult struct {
+	ServiceName    string          `json:"serviceName,omitempty"`
+	ServiceGate    string          `json:"serviceGate,omitempty"`
+	ServiceScore   Score           `json:"serviceScore,omitempty"`
+	LogAnalysis    *AnalysisResult `json:"logAnalysis,omitempty"`
+	MetricAnalysis *AnalysisResult `json:"metricAnalysis,omitempty"`
+}
+
+// AnalysisResult is the log or metric part of the score of a service
+type AnalysisResult struct {
+	Score   Score          `json:"score,omitempty"`
+	Result  string         `json:"result,omitempty"`
+	Metrics []MetricResult `json:"metrics,omitempty"`
+}
+
+// MetricResult is the verdict of ISD on a single metric of a service
+type MetricResult struct {
+	Name   string `json:"name"`
+	Score  Score  `json:"score,omitempty"`
+	Result string `json:"result,omitempty"`
+}
+
+// Number and score of the interval ISD has scored last, if it is not lastIntervalNo
+func (s CanaryStatusResponse) newIntervalScore(lastIntervalNo string) (string, int, bool) {
+	intervalNo := s.CanaryResult.IntervalNo.String()
+	if intervalNo == "" || intervalNo == lastIntervalNo || s.CanaryResult.OverallScore == "" {
+		return lastIntervalNo, 0, false
+	}
+	score, err := s.CanaryResult.OverallScore.value()
+	if err != nil {
+		log.Warnf("could not read the score of interval %s: %v", intervalNo, err)
+		return lastIntervalNo, 0, false
+	}
+	return intervalNo, score, true
+}
+
+// Metrics of the service that ISD did not find healthy, as <service>/<metric>
+func (s ServiceResult) unhealthyMetrics() []string {
+	var metrics []string
+	for _, analysis := range []*AnalysisResult{s.LogAnalysis, s.MetricAnalysis} {
+		if analysis == nil {
+			continue
+		}
+		for _, metric := range analysis.Metrics {
+			if metric.Result != "" && metric.Result != canaryResultHealthy {
+				metrics = append(metrics, fmt.Sprintf("%s/%s", s.ServiceName, metric.Name))
+			}
+		}
+	}
+	return metrics
+}
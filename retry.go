@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = 1 * time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// RetryPolicy is how often and how long apart the calls to ISD are retried on transient failures
+type RetryPolicy struct {
+	Attempts  int           `yaml:"attempts,omitempty"`
+	BaseDelay time.Duration `yaml:"baseDelay,omitempty"`
+	MaxDelay  time.Duration `yaml:"maxDelay,omitempty"`
+}
+
+// Retry-After is either a number of seconds or an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// Timeouts, connection failures and unavailable responses are worth another attempt. Anything else is permanent,
+// such as an unsupported URL, too many redirects or a certificate that cannot be verified.
+func isRetryable(err error) bool {
+	var responseErr *ISDResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.retryable()
+	}
+	if errors.Is(err, context.Canceled) || isCertificateError(err) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// A request that is not idempotent is only retried when ISD provably did not process it: the connection could not
+// be made, or ISD asked to come back later with a Retry-After. A lost response to a registerCanary would otherwise
+// register a second canary.
+func retryableFor(method string) func(error) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return isRetryable
+	}
+	return func(err error) bool {
+		if !isRetryable(err) {
+			return false
+		}
+		var responseErr *ISDResponseError
+		if errors.As(err, &responseErr) {
+			unavailable := responseErr.StatusCode == http.StatusTooManyRequests || responseErr.StatusCode == http.StatusServiceUnavailable
+			return unavailable && responseErr.RetryAfter > 0
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		var dnsErr *net.DNSError
+		return errors.As(err, &dnsErr)
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts == 0 {
+		p.Attempts = defaultRetryAttempts
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	return p
+}
+
+func (p RetryPolicy) errors() []error {
+	var errs []error
+	if p.Attempts < 0 {
+		errs = append(errs, errors.New("provider config map validation error: retry attempts cannot be negative"))
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < 0 {
+		errs = append(errs, errors.New("provider config map validation error: retry baseDelay and maxDelay cannot be negative"))
+	}
+	if p.MaxDelay != 0 && p.MaxDelay < p.BaseDelay {
+		errs = append(errs, errors.New("provider config map validation error: retry maxDelay cannot be less than baseDelay"))
+	}
+	return errs
+}
+
+// Exponential backoff with full jitter, a Retry-After sent by ISD takes precedence
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	var responseErr *ISDResponseError
+	if errors.As(err, &responseErr) && responseErr.RetryAfter > 0 {
+		return responseErr.RetryAfter
+	}
+	backoff := p.MaxDelay
+	if attempt < 30 && p.BaseDelay<<attempt < p.MaxDelay {
+		backoff = p.BaseDelay << attempt
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// Run the idempotent fn until it succeeds, fails permanently, runs out of attempts or ctx is done
+func (p RetryPolicy) do(ctx context.Context, operation string, fn func() error) error {
+	return p.doIf(ctx, operation, isRetryable, fn)
+}
+
+// Run fn until it succeeds, fails with an error that is not retryable, runs out of attempts or ctx is done
+func (p RetryPolicy) doIf(ctx context.Context, operation string, retryable func(error) bool, fn func() error) error {
+	p = p.withDefaults()
+	var err error
+	for attempt := 0; attempt < p.Attempts; attempt++ {
+		if attempt > 0 {
+			wait := p.delay(attempt-1, err)
+			log.Warnf("%s failed, retrying in %v (attempt %d of %d): %v", operation, wait, attempt+1, p.Attempts, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(wait):
+			}
+		}
+		err = fn()
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
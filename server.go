@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	canariesPath = "/canaries/"
+	//the posted provider config is read up to this size
+	maxProviderConfigBytes = 1 << 20
+	defaultCanaryTTL       = time.Hour
+	defaultMaxCanaries     = 100
+)
+
+// ServedCanary is the state of a canary served to the Argo Rollouts web metric provider
+type ServedCanary struct {
+	CanaryId  string `json:"canaryId"`
+	Status    string `json:"status"`
+	Score     string `json:"score,omitempty"`
+	Phase     string `json:"phase"`
+	ReportUrl string `json:"reportUrl,omitempty"`
+	Message   string `json:"message,omitempty"`
+	//per-service scores and per-metric verdicts of ISD
+	Services []ServiceResult `json:"services,omitempty"`
+}
+
+// CanaryServer registers the canaries posted to it and keeps polling ISD for their score in memory. A finished
+// canary is served for ttl, and at most maxCanaries canaries are polled at a time.
+type CanaryServer struct {
+	clients     *Clients
+	paths       ConfigPaths
+	ttl         time.Duration
+	maxCanaries int
+	mu          sync.RWMutex
+	canaries    map[string]ServedCanary
+	polling     int
+}
+
+func newCanaryServer(clients *Clients, paths ConfigPaths) *CanaryServer {
+	return &CanaryServer{
+		clients:     clients,
+		paths:       paths,
+		ttl:         defaultCanaryTTL,
+		maxCanaries: defaultMaxCanaries,
+		canaries:    map[string]ServedCanary{},
+	}
+}
+
+func (s *CanaryServer) get(canaryId string) (ServedCanary, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	canary, ok := s.canaries[canaryId]
+	return canary, ok
+}
+
+func (s *CanaryServer) set(canary ServedCanary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canaries[canary.CanaryId] = canary
+}
+
+// Reserve a poll for a new canary, false when maxCanaries canaries are already polled
+func (s *CanaryServer) startPolling() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.polling >= s.maxCanaries {
+		return false
+	}
+	s.polling++
+	return true
+}
+
+func (s *CanaryServer) releasePolling() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polling--
+}
+
+// Release the poll of a finished canary, the canary is removed once ttl has passed
+func (s *CanaryServer) stopPolling(canaryId string) {
+	s.releasePolling()
+	time.AfterFunc(s.ttl, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.canaries, canaryId)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	writeJSON(w, statusCode, map[string]string{"message": err.Error()})
+}
+
+// Handler of the server, POST /canaries/ registers a canary and GET /canaries/<canaryId> returns its state
+func (s *CanaryServer) handler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(canariesPath, func(w http.ResponseWriter, r *http.Request) {
+		canaryId := strings.TrimPrefix(r.URL.Path, canariesPath)
+		switch {
+		case r.Method == http.MethodPost && canaryId == "":
+			s.registerCanary(ctx, w, r)
+		case r.Method == http.MethodGet && canaryId != "":
+			canary, ok := s.get(canaryId)
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Errorf("canary ID %s not found", canaryId))
+				return
+			}
+			writeJSON(w, http.StatusOK, canary)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s %s is not supported", r.Method, r.URL.Path))
+		}
+	})
+	return mux
+}
+
+func (s *CanaryServer) registerCanary(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxProviderConfigBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("provider config map validation error: the provider config cannot be larger than %d bytes", tooLarge.Limit))
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	//the provider config is posted as json, which yaml.v2 reads as well
+	var metric OPSMXMetric
+	if err := yaml.Unmarshal(data, &metric); err != nil {
+		errorMsg := fmt.Sprintf("provider config map validation error: %v", err)
+		writeError(w, http.StatusBadRequest, errors.New(errorMsg))
+		return
+	}
+	if metric.Application == "" {
+		writeError(w, http.StatusBadRequest, errors.New("provider config map validation error: application has to be set in the provider config"))
+		return
+	}
+	//the credentials of the secret are sent to opsmxIsdUrl, so it is only taken from the mounted secret
+	if metric.OpsmxIsdUrl != "" {
+		writeError(w, http.StatusBadRequest, errors.New("provider config map validation error: opsmxIsdUrl cannot be posted to the server, it is read from the opsmx profile secret"))
+		return
+	}
+	if err := metric.basicChecks(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	secretData, err := metric.getDataSecret(s.paths.secrets)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := metric.getTimeVariables(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.startPolling() {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("%d canaries are already being analysed, retry once one of them has finished", s.maxCanaries))
+		return
+	}
+	canaryId, _, urlToken, err := metric.registerCanary(r.Context(), s.clients, secretData, s.paths.templates)
+	if err != nil {
+		s.releasePolling()
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	log.Infof("registered canary ID %s for application %s", canaryId, metric.Application)
+
+	canary := ServedCanary{
+		CanaryId: canaryId,
+		Status:   canaryStatusRunning,
+		Phase:    AnalysisPhaseRunning,
+	}
+	s.set(canary)
+	go s.poll(ctx, canary, s.clients.isdClient(secretData, metric.Retry), urlToken, metric)
+
+	w.Header().Set("Location", canariesPath+canaryId)
+	writeJSON(w, http.StatusCreated, canary)
+}
+
+// Poll ISD for the score of a canary until it is no longer running, as set in the poll policy of the canary
+func (s *CanaryServer) poll(ctx context.Context, canary ServedCanary, isd ISDClient, reportToken string, metric OPSMXMetric) {
+	defer s.stopPolling(canary.CanaryId)
+	wait := metric.Poll.firstWait(metric.firstScoreAt())
+	for polls := 0; ; polls++ {
+		if polls > 0 {
+			wait = metric.Poll.wait(polls - 1)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		//transient failures are already retried by the ISD client
+		status, err := getCanaryStatus(ctx, isd, canary.CanaryId, reportToken, metric)
+		if err != nil {
+			canary.Phase = AnalysisPhaseError
+			canary.Message = fmt.Sprintf("analysis Error: Error in getting canary Response: %v", err)
+			s.set(canary)
+			return
+		}
+		canary.Status = status.status
+		canary.Score = status.score
+		canary.Phase = status.phase
+		canary.ReportUrl = status.reportUrl
+		canary.Services = status.services
+		if status.status == canaryStatusCancelled {
+			canary.Phase = AnalysisPhaseError
+			canary.Message = "The analysis has Cancelled"
+		}
+		s.set(canary)
+		if status.status != canaryStatusRunning {
+			log.Infof("canary ID %s finished with status %s", canary.CanaryId, status.status)
+			return
+		}
+	}
+}
+
+// Entry point of the serve subcommand, returns the exit code of the process
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	defaultPaths := newConfigPaths(defaultBasePath)
+	listen := fs.String("listen", ":8080", "address the server listens on")
+	templatesPath := fs.String("templates-dir", getEnvOrDefault("TEMPLATES_DIR", defaultPaths.templates), "directory of the gitops templates, can also be set through TEMPLATES_DIR")
+	secretsPath := fs.String("secrets-dir", getEnvOrDefault("SECRETS_DIR", defaultPaths.secrets), "directory of the opsmx profile secret, can also be set through SECRETS_DIR")
+	ttl := fs.Duration("canary-ttl", defaultCanaryTTL, "how long a finished canary is served before it is removed")
+	maxCanaries := fs.Int("max-canaries", defaultMaxCanaries, "number of canaries polled at a time, more are rejected with 503")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	s := newCanaryServer(newClients(nil, NewHttpClient()), ConfigPaths{templates: *templatesPath, secrets: *secretsPath})
+	s.ttl = *ttl
+	s.maxCanaries = *maxCanaries
+	if err := s.clients.configureTLS(*secretsPath); err != nil {
+		log.Error(err)
+		return int(ReturnCodeError)
+	}
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           s.handler(ctx),
+		ReadHeaderTimeout: httpConnectionTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpConnectionTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("serving canaries on %s", *listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error(err)
+		return int(ReturnCodeError)
+	}
+	return int(ReturnCodeSuccess)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/argoproj/argo-rollouts/utils/defaults"
+	"github.com/opsmx/argo-metricprovider-job/analysis"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CanaryStatus is the state of an existing canary as reported by ISD
+type CanaryStatus struct {
+	canaryId  string
+	status    string
+	score     string
+	phase     string
+	reportUrl string
+	services  []ServiceResult
+}
+
+// CanaryReport is the JSON output of the status subcommand
+type CanaryReport struct {
+	CanaryId         string          `json:"canaryId"`
+	Status           string          `json:"status"`
+	Score            string          `json:"score"`
+	Phase            string          `json:"phase"`
+	ReportUrl        string          `json:"reportUrl,omitempty"`
+	Services         []ServiceResult `json:"services,omitempty"`
+	UnhealthyMetrics []string        `json:"unhealthyMetrics,omitempty"`
+}
+
+// Fetch the score of an already registered canary and evaluate it against the scores of the metric
+func getCanaryStatus(ctx context.Context, isd ISDClient, canaryId string, reportToken string, metric OPSMXMetric) (CanaryStatus, error) {
+	canary, err := isd.GetCanaryStatus(ctx, CanaryStatusRequest{
+		CanaryId:    canaryId,
+		ReportToken: reportToken,
+	})
+	if err != nil {
+		return CanaryStatus{}, err
+	}
+	if err := canary.statusError(canaryId); err != nil {
+		return CanaryStatus{}, err
+	}
+
+	phase, score, err := metric.processResume(canary.CanaryResult)
+	if err != nil {
+		return CanaryStatus{}, err
+	}
+	if canary.Status.Status == canaryStatusRunning {
+		phase = AnalysisPhaseRunning
+	} else if canary.Status.Status == canaryStatusCompleted {
+		failedGates, err := metric.failedGates(canary.Services)
+		if err != nil {
+			return CanaryStatus{}, err
+		}
+		if len(failedGates) != 0 {
+			log.Infof("canary ID %s failed: %s", canaryId, strings.Join(failedGates, ", "))
+			phase = AnalysisPhaseFailed
+		}
+	}
+	return CanaryStatus{
+		canaryId:  canaryId,
+		status:    canary.Status.Status,
+		score:     score,
+		phase:     phase,
+		reportUrl: canary.CanaryResult.CanaryReportURL,
+		services:  canary.Services,
+	}, nil
+}
+
+// Metrics ISD did not find healthy across every service
+func (s CanaryStatus) unhealthyMetrics() []string {
+	var metrics []string
+	for _, service := range s.services {
+		metrics = append(metrics, service.unhealthyMetrics()...)
+	}
+	return metrics
+}
+
+func (s CanaryStatus) print(out io.Writer) {
+	fmt.Fprintf(out, "canaryId:  %s\n", s.canaryId)
+	fmt.Fprintf(out, "status:    %s\n", s.status)
+	fmt.Fprintf(out, "score:     %s\n", s.score)
+	fmt.Fprintf(out, "phase:     %s\n", s.phase)
+	fmt.Fprintf(out, "reportUrl: %s\n", s.reportUrl)
+	for _, service := range s.services {
+		fmt.Fprintf(out, "service:   %s (%s) %s\n", service.ServiceName, service.ServiceGate, service.ServiceScore)
+	}
+	for _, metric := range s.unhealthyMetrics() {
+		fmt.Fprintf(out, "unhealthy: %s\n", metric)
+	}
+}
+
+func (s CanaryStatus) printJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(CanaryReport{
+		CanaryId:         s.canaryId,
+		Status:           s.status,
+		Score:            s.score,
+		Phase:            s.phase,
+		ReportUrl:        s.reportUrl,
+		Services:         s.services,
+		UnhealthyMetrics: s.unhealthyMetrics(),
+	})
+}
+
+func (s CanaryStatus) exitCode() ExitCode {
+	switch {
+	case s.status == canaryStatusCancelled:
+		return ReturnCodeCancelled
+	case s.phase == AnalysisPhaseFailed:
+		return ReturnCodeFailed
+	case s.phase == AnalysisPhaseInconclusive:
+		return ReturnCodeInconclusive
+	}
+	return ReturnCodeSuccess
+}
+
+// Read a key of the opsmx profile secret when it is not given on the command line
+func readSecretKey(value string, secretsPath string, key string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(filepath.Join(secretsPath, key))
+	if err != nil {
+		errorMsg := fmt.Sprintf("opsmx profile secret validation error: `%s` key not present in the secret file and not given as a flag", key)
+		return "", errors.New(errorMsg)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Canary ID of the analysis Job whose OpsmxAnalysis condition carries the report token, ISD only looks canaries up by ID
+func canaryIdOfReportToken(ctx context.Context, kubeclient kubernetes.Interface, reportToken string) (string, error) {
+	jobs, err := kubeclient.BatchV1().Jobs(defaults.Namespace()).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, job := range jobs.Items {
+		for _, condition := range job.Status.Conditions {
+			if condition.Type != analysis.ConditionType {
+				continue
+			}
+			details, err := analysis.Parse(condition.Message)
+			if err == nil && details.ReportId == reportToken && details.CanaryId != "" {
+				return details.CanaryId, nil
+			}
+		}
+	}
+	errorMsg := fmt.Sprintf("analysis Error: no analysis Job of namespace %s carries the report token", defaults.Namespace())
+	return "", errors.New(errorMsg)
+}
+
+// Entry point of the status subcommand, returns the exit code of the process. The report is written to out and
+// errors to errOut, so that the json output stays parseable.
+func statusCommand(args []string, out io.Writer, errOut io.Writer) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s status [flags] <canaryId>\n       %s status [flags] --report-token <reportToken>\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	reportToken := fs.String("report-token", "", "report token of the canary, sent along with the request, the canary is looked up by it when no canaryId is given")
+	kubeconfig := fs.String("kubeconfig", "", "kubeconfig file used to look up the canary of the report token outside the cluster")
+	kubeContext := fs.String("context", "", "kubeconfig context used to look up the canary of the report token")
+	namespace := fs.String("namespace", "", "namespace of the analysis Jobs searched for the report token")
+	passScore := fs.Int("pass-score", 80, "score the canary has to reach to be Successful")
+	marginalScore := fs.Int("marginal-score", 0, "score from which a canary below the pass score is Inconclusive instead of Failed")
+	opsmxIsdUrl := fs.String("isd-url", "", "ISD url, read from the secrets directory when empty")
+	user := fs.String("user", "", "ISD user, read from the secrets directory when empty")
+	output := fs.String("output", "text", "output format, text or json")
+	secretsPath := fs.String("secrets-dir", getEnvOrDefault("SECRETS_DIR", newConfigPaths(defaultBasePath).secrets), "directory of the opsmx profile secret")
+	_ = fs.Parse(args)
+	log.SetLevel(log.WarnLevel)
+
+	if fs.NArg() > 1 || (fs.NArg() == 0 && *reportToken == "") {
+		fs.Usage()
+		return int(ReturnCodeError)
+	}
+	canaryId := fs.Arg(0)
+	if canaryId == "" {
+		config, err := newRestConfig(*kubeconfig, *kubeContext, *namespace)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return int(ReturnCodeError)
+		}
+		kubeclient, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return int(ReturnCodeError)
+		}
+		canaryId, err = canaryIdOfReportToken(context.Background(), kubeclient, *reportToken)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return int(ReturnCodeError)
+		}
+	}
+	isdUrl, err := readSecretKey(*opsmxIsdUrl, *secretsPath, "opsmxIsdUrl")
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return int(ReturnCodeError)
+	}
+	isdUser, err := readSecretKey(*user, *secretsPath, "user")
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return int(ReturnCodeError)
+	}
+
+	secretData, err := getAuthSecret(*secretsPath)
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return int(ReturnCodeError)
+	}
+	secretData["opsmxIsdUrl"] = isdUrl
+	secretData["user"] = isdUser
+	clients := newClients(nil, NewHttpClient())
+	if err := clients.configureTLS(*secretsPath); err != nil {
+		fmt.Fprintln(errOut, err)
+		return int(ReturnCodeError)
+	}
+	status, err := getCanaryStatus(context.Background(), newISDClient(clients.client, secretData, RetryPolicy{}), canaryId, *reportToken, OPSMXMetric{Pass: *passScore, Marginal: *marginalScore})
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+		return int(ReturnCodeError)
+	}
+	if *output == "json" {
+		if err := status.printJSON(out); err != nil {
+			fmt.Fprintln(errOut, err)
+			return int(ReturnCodeError)
+		}
+	} else {
+		status.print(out)
+	}
+	return int(status.exitCode())
+}
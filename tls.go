@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Build the TLS config of the ISD connections from the optional ca.crt, tls.crt, tls.key and
+// insecureSkipVerify keys of the secret, nil when none of them is set
+func getTLSConfig(secretsPath string) (*tls.Config, error) {
+	readKey := func(key string) ([]byte, bool) {
+		data, err := os.ReadFile(filepath.Join(secretsPath, key))
+		if err != nil {
+			return nil, false
+		}
+		return data, true
+	}
+	caCert, hasCA := readKey("ca.crt")
+	clientCert, hasCert := readKey("tls.crt")
+	clientKey, hasKey := readKey("tls.key")
+	insecure, _ := readKey("insecureSkipVerify")
+	insecureSkipVerify := strings.TrimSpace(string(insecure)) == "true"
+	if !hasCA && !hasCert && !hasKey && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if hasCA {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("opsmx profile secret validation error: `ca.crt` does not contain a PEM encoded certificate")
+		}
+		config.RootCAs = pool
+	}
+	if hasCert != hasKey {
+		return nil, errors.New("opsmx profile secret validation error: `tls.crt` and `tls.key` have to be given together for client certificate authentication")
+	}
+	if hasCert {
+		certificate, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			errorMsg := fmt.Sprintf("opsmx profile secret validation error: invalid client certificate in `tls.crt` and `tls.key`: %v", err)
+			return nil, errors.New(errorMsg)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if insecureSkipVerify {
+		log.Warn("insecureSkipVerify is set, the certificate of ISD is not verified")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// Use the TLS material of the secret for the connections to ISD, the client is left untouched when there is none
+func (c *Clients) configureTLS(secretsPath string) error {
+	config, err := getTLSConfig(secretsPath)
+	if err != nil || config == nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.client.Transport = transport
+	return nil
+}
+
+// Errors of the TLS handshake, either the certificate of ISD could not be verified or ISD refused ours
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "remote error: tls:")
+}
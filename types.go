@@ -2,17 +2,20 @@ package main
 
 import (
 	"net/http"
+	"time"
 
+	argoclientset "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	AnalysisPhasePending    = "Pending"
-	AnalysisPhaseRunning    = "Running"
-	AnalysisPhaseSuccessful = "Successful"
-	AnalysisPhaseFailed     = "Failed"
-	AnalysisPhaseError      = "Error"
+	AnalysisPhasePending      = "Pending"
+	AnalysisPhaseRunning      = "Running"
+	AnalysisPhaseSuccessful   = "Successful"
+	AnalysisPhaseFailed       = "Failed"
+	AnalysisPhaseError        = "Error"
+	AnalysisPhaseInconclusive = "Inconclusive"
 )
 
 type ExitCode int
@@ -27,11 +30,26 @@ const (
 
 type Clients struct {
 	kubeclientset kubernetes.Interface
+	//annotates the AnalysisRun and Rollout owning the Job, nil when they are not annotated
+	argoclientset argoclientset.Interface
 	client        http.Client
+	isd           ISDClient
+	dryRun        bool
+	templates     []RenderedTemplate
+	//owners of the Job of the run, read once
+	owners *JobOwners
+}
+
+// RenderedTemplate is a processed gitops template collected during a dry run
+type RenderedTemplate struct {
+	name         string
+	templateType string
+	data         []byte
 }
 
 type Conditions struct {
 	Message       string      `json:"message,omitempty"`
+	Reason        string      `json:"reason,omitempty"`
 	Type          string      `json:"type,omitempty"`
 	Status        string      `json:"status,omitempty"`
 	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
@@ -50,6 +68,17 @@ type ResourceNames struct {
 	jobName string
 }
 
+type RunOptions struct {
+	jobName string
+	paths   ConfigPaths
+}
+
+type ConfigPaths struct {
+	providerConfig string
+	templates      string
+	secrets        string
+}
+
 type CanaryDetails struct {
 	user      string
 	jobName   string
@@ -57,6 +86,12 @@ type CanaryDetails struct {
 	reportUrl string
 	value     string
 	ReportId  string
+	phase     string
+	//zero for a canary registered by a job writing the legacy message
+	registeredAt time.Time
+	services     []ServiceResult
+	//error the analysis ended with in the Error phase
+	errorMessage string
 }
 
 type OPSMXMetric struct {
@@ -70,11 +105,16 @@ type OPSMXMetric struct {
 	GlobalLogTemplate    string         `yaml:"globalLogTemplate,omitempty"`
 	GlobalMetricTemplate string         `yaml:"globalMetricTemplate,omitempty"`
 	Pass                 int            `yaml:"passScore"`
+	Marginal             int            `yaml:"marginalScore,omitempty"`
+	AbortBelow           int            `yaml:"abortBelowScore,omitempty"`
 	Services             []OPSMXService `yaml:"serviceList,omitempty"`
 	IntervalTime         int            `yaml:"intervalTime,omitempty"`
 	LookBackType         string         `yaml:"lookBackType,omitempty"`
 	Delay                int            `yaml:"delay,omitempty"`
 	GitOPS               bool           `yaml:"gitops,omitempty"`
+	Retry                RetryPolicy    `yaml:"retry,omitempty"`
+	Deadline             DeadlinePolicy `yaml:"deadline,omitempty"`
+	Poll                 PollPolicy     `yaml:"poll,omitempty"`
 }
 
 type OPSMXService struct {
@@ -89,6 +129,7 @@ type OPSMXService struct {
 	BaselineMetricScope   string `yaml:"baselineMetricScope,omitempty"`
 	CanaryMetricScope     string `yaml:"canaryMetricScope,omitempty"`
 	ServiceName           string `yaml:"serviceName,omitempty"`
+	PassScore             int    `yaml:"passScore,omitempty"`
 }
 
 type jobPayload struct {
@@ -7,16 +7,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/argoproj/argo-rollouts/utils/defaults"
+	"github.com/opsmx/argo-metricprovider-job/analysis"
 	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 	"gopkg.in/yaml.v2"
@@ -145,9 +144,8 @@ func logNon0CodeExit(exitcode ExitCode) {
 	os.Exit(int(exitcode))
 }
 
-func getJobNameFromPod(p *Clients, podName string) (string, error) {
+func getJobNameFromPod(ctx context.Context, p *Clients, podName string) (string, error) {
 	ns := defaults.Namespace()
-	ctx := context.TODO()
 	pod, err := p.kubeclientset.CoreV1().Pods(ns).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
 		return "", err
@@ -159,20 +157,25 @@ func getJobNameFromPod(p *Clients, podName string) (string, error) {
 	return podOwner.Name, nil
 }
 
-func checkPatchabilityReturnResources(c *Clients) (ResourceNames, error) {
+func checkPatchabilityReturnResources(ctx context.Context, c *Clients, jobName string) (ResourceNames, error) {
 
-	podName, ok := os.LookupEnv("MY_POD_NAME")
-	if !ok {
-		return ResourceNames{}, errors.New("analysisTemplate validation error: environment variable MY_POD_NAME is not set")
-	}
+	var podName string
+	if jobName == "" {
+		var ok bool
+		podName, ok = os.LookupEnv("MY_POD_NAME")
+		if !ok {
+			return ResourceNames{}, errors.New("analysisTemplate validation error: environment variable MY_POD_NAME is not set")
+		}
 
-	jobName, err := getJobNameFromPod(c, podName)
-	if err != nil {
-		return ResourceNames{}, err
+		var err error
+		jobName, err = getJobNameFromPod(ctx, c, podName)
+		if err != nil {
+			return ResourceNames{}, err
+		}
 	}
 
 	log.Println("jobname earlier ", jobName)
-	_, err = c.kubeclientset.BatchV1().Jobs(defaults.Namespace()).Patch(context.TODO(), jobName, types.StrategicMergePatchType, []byte(`{}`), metav1.PatchOptions{}, "status")
+	_, err := c.kubeclientset.BatchV1().Jobs(defaults.Namespace()).Patch(ctx, jobName, types.StrategicMergePatchType, []byte(`{}`), metav1.PatchOptions{}, "status")
 	if err != nil {
 		log.Error("cannot patch to Job")
 		return ResourceNames{}, err
@@ -197,38 +200,29 @@ func roundFloat(val float64, precision uint) float64 {
 	return math.Round(val*ratio) / ratio
 }
 
-func makeRequest(client http.Client, requestType string, url string, body string, user string) ([]byte, string, string, error) {
-	reqBody := strings.NewReader(body)
-	req, _ := http.NewRequest(
-		requestType,
-		url,
-		reqBody,
-	)
-
-	req.Header.Set("x-spinnaker-user", user)
-	req.Header.Set("Content-Type", "application/json")
-
-	res, err := client.Do(req)
-	if err != nil {
-		return []byte{}, "", "", err
-	}
-	defer res.Body.Close()
-	data, err := io.ReadAll(res.Body)
-	if err != nil {
-		return []byte{}, "", "", err
-	}
-	var urlScore string
-	var urlToken string
-	if strings.Contains(url, "registerCanary") {
-		urlScore = res.Header.Get("Location")
-		urlToken = res.Header.Get("x-opsmx-report-token")
-	}
-	return data, urlScore, urlToken, err
-}
-
-func (metric *OPSMXMetric) checkISDUrl(c *Clients, opsmxIsdUrl string) error {
-	resp, err := c.client.Get(opsmxIsdUrl)
-	if err != nil && metric.OpsmxIsdUrl != "" && !strings.Contains(err.Error(), "timeout") {
+func (metric *OPSMXMetric) checkISDUrl(ctx context.Context, c *Clients, secretData map[string]string) error {
+	opsmxIsdUrl := secretData["opsmxIsdUrl"]
+	var resp *http.Response
+	err := metric.Retry.do(ctx, "GET "+opsmxIsdUrl, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", opsmxIsdUrl, nil)
+		if err != nil {
+			return err
+		}
+		newISDAuth(secretData).apply(req)
+		resp, err = c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkResponse(req, resp, nil)
+	})
+	var responseErr *ISDResponseError
+	if errors.As(err, &responseErr) {
+		return err
+	} else if isCertificateError(err) {
+		errorMsg := fmt.Sprintf("opsmx profile secret validation error: TLS handshake with opsmxIsdUrl %s failed: %v\n Action Required: the secret has to carry the CA of ISD as 'ca.crt', and 'tls.crt' and 'tls.key' when ISD requires client certificates", opsmxIsdUrl, err)
+		return errors.New(errorMsg)
+	} else if err != nil && metric.OpsmxIsdUrl != "" && !strings.Contains(err.Error(), "timeout") {
 		errorMsg := fmt.Sprintf("provider config map validation error: incorrect opsmxIsdUrl: %v", opsmxIsdUrl)
 		return errors.New(errorMsg)
 	} else if err != nil && metric.OpsmxIsdUrl == "" && !strings.Contains(err.Error(), "timeout") {
@@ -244,22 +238,49 @@ func (metric *OPSMXMetric) checkISDUrl(c *Clients, opsmxIsdUrl string) error {
 
 // Check few conditions pre-analysis
 func (metric *OPSMXMetric) basicChecks() error {
+	if errs := metric.basicCheckErrors(); len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Return every error found by the pre-analysis checks
+func (metric *OPSMXMetric) basicCheckErrors() []error {
+	var errs []error
 	if metric.LifetimeMinutes == 0 && metric.EndTime == "" {
-		return errors.New("provider config map validation error: provide either lifetimeMinutes or end time")
+		errs = append(errs, errors.New("provider config map validation error: provide either lifetimeMinutes or end time"))
 	}
 	if metric.CanaryStartTime != metric.BaselineStartTime && metric.LifetimeMinutes == 0 {
-		return errors.New("provider config map validation error: both canaryStartTime and baselineStartTime should be kept same while using endTime argument for analysis")
+		errs = append(errs, errors.New("provider config map validation error: both canaryStartTime and baselineStartTime should be kept same while using endTime argument for analysis"))
 	}
 	if metric.LifetimeMinutes != 0 && metric.LifetimeMinutes < 3 {
-		return errors.New("provider config map validation error: lifetimeMinutes cannot be less than 3 minutes")
+		errs = append(errs, errors.New("provider config map validation error: lifetimeMinutes cannot be less than 3 minutes"))
 	}
 	if metric.IntervalTime != 0 && metric.IntervalTime < 3 {
-		return errors.New("provider config map validation error: intervalTime cannot be less than 3 minutes")
+		errs = append(errs, errors.New("provider config map validation error: intervalTime cannot be less than 3 minutes"))
 	}
 	if metric.LookBackType != "" && metric.IntervalTime == 0 {
-		return errors.New("provider config map validation error: intervalTime should be given along with lookBackType to perform interval analysis")
+		errs = append(errs, errors.New("provider config map validation error: intervalTime should be given along with lookBackType to perform interval analysis"))
 	}
-	return nil
+	for i, item := range metric.Services {
+		if item.PassScore < 0 || item.PassScore > 100 {
+			errorMsg := fmt.Sprintf("provider config map validation error: passScore of service%d has to be between 0 and 100", i+1)
+			errs = append(errs, errors.New(errorMsg))
+		}
+	}
+	if metric.Marginal < 0 || (metric.Marginal != 0 && metric.Marginal >= metric.Pass) {
+		errs = append(errs, errors.New("provider config map validation error: marginalScore has to be less than passScore"))
+	}
+	if metric.AbortBelow < 0 || (metric.AbortBelow != 0 && metric.AbortBelow > metric.Pass) {
+		errs = append(errs, errors.New("provider config map validation error: abortBelowScore cannot be more than passScore"))
+	}
+	if metric.AbortBelow != 0 && metric.IntervalTime == 0 {
+		errs = append(errs, errors.New("provider config map validation error: intervalTime should be given along with abortBelowScore to abort on interval scores"))
+	}
+	errs = append(errs, metric.Retry.errors()...)
+	errs = append(errs, metric.Deadline.errors()...)
+	errs = append(errs, metric.Poll.errors()...)
+	return errs
 }
 
 // Return epoch values of the specific time provided along with lifetimeMinutes for the Run
@@ -315,11 +336,10 @@ func (metric *OPSMXMetric) getTimeVariables() error {
 	return nil
 }
 
-func getAnalysisTemplateData(basePath string) (OPSMXMetric, error) {
-	path := filepath.Join(basePath, "provider/providerConfig")
-	data, err := os.ReadFile(path)
+func getAnalysisTemplateData(providerConfigPath string) (OPSMXMetric, error) {
+	data, err := os.ReadFile(providerConfigPath)
 	if err != nil {
-		errorMsg := fmt.Sprintf("provider config map validation error: %v\n Action Required: Provider config map has to be mounted on '/etc/config/provider' in AnalysisTemplate and must carry data element 'providerConfig'", err)
+		errorMsg := fmt.Sprintf("provider config map validation error: %v\n Action Required: Provider config map has to be mounted on '%s' in AnalysisTemplate and must carry data element '%s'", err, filepath.Dir(providerConfigPath), filepath.Base(providerConfigPath))
 		err = errors.New(errorMsg)
 		return OPSMXMetric{}, err
 	}
@@ -341,8 +361,11 @@ func getAnalysisTemplateData(basePath string) (OPSMXMetric, error) {
 	return opsmx, nil
 }
 
-func getProviderConfigNameFromJob(c *Clients, r ResourceNames) (string, error) {
-	jobValue, err := c.kubeclientset.BatchV1().Jobs(defaults.Namespace()).Get(context.TODO(), r.jobName, metav1.GetOptions{})
+func getProviderConfigNameFromJob(ctx context.Context, c *Clients, r ResourceNames) (string, error) {
+	if c.kubeclientset == nil {
+		return "", errors.New("provider config map validation error: application has to be set in the provider config map or through the APP_NAME environment variable when Kubernetes is not used")
+	}
+	jobValue, err := c.kubeclientset.BatchV1().Jobs(defaults.Namespace()).Get(ctx, r.jobName, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
@@ -353,13 +376,54 @@ func getProviderConfigNameFromJob(c *Clients, r ResourceNames) (string, error) {
 			break
 		}
 	}
-	analysisTemplate, err := c.kubeclientset.CoreV1().ConfigMaps(defaults.Namespace()).Get(context.TODO(), analysisTemplateName, metav1.GetOptions{})
+	analysisTemplate, err := c.kubeclientset.CoreV1().ConfigMaps(defaults.Namespace()).Get(ctx, analysisTemplateName, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
 	return analysisTemplate.ObjectMeta.Labels["argocd.argoproj.io/instance"], nil
 }
 
+// Return the canary details patched to the Job by a previous pod, empty if no canary was registered yet
+func getRegisteredCanary(ctx context.Context, c *Clients, r ResourceNames) CanaryDetails {
+	if c.kubeclientset == nil || r.jobName == "" {
+		return CanaryDetails{}
+	}
+	job, err := c.kubeclientset.BatchV1().Jobs(defaults.Namespace()).Get(ctx, r.jobName, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("could not look up a canary registered by a previous pod of the Job: %v", err)
+		return CanaryDetails{}
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == analysis.ConditionType {
+			return parseCanaryDetails(condition.Message)
+		}
+	}
+	return CanaryDetails{}
+}
+
+// Parse the message written by patchJobCanaryDetails, or by a job writing the legacy analysisDetails message
+func parseCanaryDetails(message string) CanaryDetails {
+	details, err := analysis.Parse(message)
+	if err != nil {
+		if !errors.Is(err, analysis.ErrNoDetails) {
+			log.Warnf("could not read the canary details of the Job: %v", err)
+		}
+		return CanaryDetails{}
+	}
+	cd := CanaryDetails{
+		user:      details.User,
+		canaryId:  details.CanaryId,
+		reportUrl: details.ReportUrl,
+		value:     details.Score,
+		ReportId:  details.ReportId,
+		phase:     details.Phase,
+	}
+	if details.RegisteredAt != nil {
+		cd.registeredAt = *details.RegisteredAt
+	}
+	return cd
+}
+
 func generateSHA1(s string) string {
 	h := sha1.New()
 	h.Write([]byte(s))
@@ -439,16 +503,15 @@ func getTemplateDataYaml(templateFileData []byte, template string, templateType
 
 }
 
-func getTemplateData(client http.Client, secretData map[string]string, template string, templateType string, basePath string, ScopeVariables string) (string, error) {
+// Read the gitops template from the mount and return the json that is sent to ISD
+func getTemplateJson(template string, templateType string, templatesPath string, ScopeVariables string) ([]byte, error) {
 	log.Info("processing gitops template", template)
-	var templateData string
-	templatePath := filepath.Join(basePath, "templates/")
-	path := filepath.Join(templatePath, template)
+	path := filepath.Join(templatesPath, template)
 	templateFileData, err := os.ReadFile(path)
 	if err != nil {
-		errorMsg := fmt.Sprintf("gitops '%s' template config map validation error: %v\n Action Required: Template has to be mounted on '/etc/config/templates' in AnalysisTemplate and must carry data element '%s'", template, err, template)
+		errorMsg := fmt.Sprintf("gitops '%s' template config map validation error: %v\n Action Required: Template has to be mounted on '%s' in AnalysisTemplate and must carry data element '%s'", template, err, templatesPath, template)
 		err = errors.New(errorMsg)
-		return "", err
+		return nil, err
 	}
 	log.Info("checking if json or yaml for template ", template)
 	if !isJSON(string(templateFileData)) {
@@ -456,99 +519,113 @@ func getTemplateData(client http.Client, secretData map[string]string, template
 		templateFileData, err = getTemplateDataYaml(templateFileData, template, templateType, ScopeVariables)
 		log.Info("json for template ", template, string(templateFileData))
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	} else {
 		checktemplateName := gjson.Get(string(templateFileData), "templateName")
 		if checktemplateName.String() == "" {
 			errmessage := fmt.Sprintf("gitops '%s' template config map validation error: template name not provided inside json", template)
-			return "", errors.New(errmessage)
+			return nil, errors.New(errmessage)
 		}
 		if template != checktemplateName.String() {
 			errmessage := fmt.Sprintf("gitops '%s' template config map validation error: Mismatch between templateName and data.%s key", template, template)
-			return "", errors.New(errmessage)
+			return nil, errors.New(errmessage)
 		}
 	}
+	return templateFileData, nil
+}
 
-	sha1Code := generateSHA1(string(templateFileData))
-	tempLink := fmt.Sprintf(templateApi, sha1Code, templateType, template)
-	s := []string{secretData["opsmxIsdUrl"], tempLink}
-	templateUrl := strings.Join(s, "")
-
-	log.Debug("sending a GET request to gitops API")
-	data, _, _, err := makeRequest(client, "GET", templateUrl, "", secretData["user"])
+func getTemplateData(ctx context.Context, isd ISDClient, template string, templateType string, templatesPath string, ScopeVariables string) (string, error) {
+	templateFileData, err := getTemplateJson(template, templateType, templatesPath, ScopeVariables)
 	if err != nil {
 		return "", err
 	}
-	var templateVerification bool
-	err = json.Unmarshal(data, &templateVerification)
+	req := TemplateRequest{
+		Name: template,
+		Type: templateType,
+		Sha1: generateSHA1(string(templateFileData)),
+		Data: templateFileData,
+	}
+
+	log.Debug("sending a GET request to gitops API")
+	templateVerification, err := isd.VerifyTemplate(ctx, req)
 	if err != nil {
-		errorMessage := fmt.Sprintf("analysis Error: Expected bool response from gitops verifyTemplate response  Error: %v. Action: Check endpoint given in secret/providerConfig.", err)
-		return "", errors.New(errorMessage)
+		return "", err
 	}
-	templateData = sha1Code
-	var templateCheckSave map[string]interface{}
 	if !templateVerification {
 		log.Debug("sending a POST request to gitops API")
-		data, _, _, err = makeRequest(client, "POST", templateUrl, string(templateFileData), secretData["user"])
-		if err != nil {
-			return "", err
-		}
-		err = json.Unmarshal(data, &templateCheckSave)
+		templateCheckSave, err := isd.SaveTemplate(ctx, req)
 		if err != nil {
 			return "", err
 		}
 		log.Debugf("the value of templateCheckSave var is %v", templateCheckSave)
-		var errorss string
-		if templateCheckSave["errorMessage"] != nil && templateCheckSave["errorMessage"] != "" {
-			errorss = fmt.Sprintf("%v", templateCheckSave["errorMessage"])
-		} else {
-			errorss = fmt.Sprintf("%v", templateCheckSave["error"])
-		}
-		errorss = strings.Replace(strings.Replace(errorss, "[", "", -1), "]", "", -1)
-		if templateCheckSave["status"] != "CREATED" {
-			err = fmt.Errorf("gitops '%s' template config map validation error: %s", template, errorss)
+		if !templateCheckSave.created() {
+			err = fmt.Errorf("gitops '%s' template config map validation error: %s", template, templateCheckSave.errorMessage())
 			return "", err
 		}
 	}
-	return templateData, nil
+	return req.Sha1, nil
+}
+
+func (c *Clients) processGitopsTemplate(ctx context.Context, isd ISDClient, template string, templateType string, templatesPath string, ScopeVariables string) (string, error) {
+	if !c.dryRun {
+		return getTemplateData(ctx, isd, template, templateType, templatesPath, ScopeVariables)
+	}
+	templateFileData, err := getTemplateJson(template, templateType, templatesPath, ScopeVariables)
+	if err != nil {
+		return "", err
+	}
+	c.templates = append(c.templates, RenderedTemplate{
+		name:         template,
+		templateType: templateType,
+		data:         templateFileData,
+	})
+	return generateSHA1(string(templateFileData)), nil
 }
 
-func (metric *OPSMXMetric) getDataSecret(basePath string) (map[string]string, error) {
+func (metric *OPSMXMetric) getDataSecret(secretsPath string) (map[string]string, error) {
 
 	secretData := map[string]string{}
-	userPath := filepath.Join(basePath, "secrets/user")
+	userPath := filepath.Join(secretsPath, "user")
 	secretUser, err := os.ReadFile(userPath)
 	if err != nil {
-		err = errors.New("opsmx profile secret validation error: `user` key not present in the secret file\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'user'")
+		err = fmt.Errorf("opsmx profile secret validation error: `user` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'user'", secretsPath)
 		return nil, err
 	}
-	opsmxIsdUrlPath := filepath.Join(basePath, "secrets/opsmxIsdUrl")
+	opsmxIsdUrlPath := filepath.Join(secretsPath, "opsmxIsdUrl")
 	opsmxIsdUrl, err := os.ReadFile(opsmxIsdUrlPath)
 	if err != nil {
-		err = errors.New("opsmx profile secret validation error: `opsmxIsdUrl` key not present in the secret file\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'opsmxIsdUrl'")
+		err = fmt.Errorf("opsmx profile secret validation error: `opsmxIsdUrl` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'opsmxIsdUrl'", secretsPath)
 		return nil, err
 	}
-	sourceNamePath := filepath.Join(basePath, "secrets/sourceName")
+	sourceNamePath := filepath.Join(secretsPath, "sourceName")
 	secretsourcename, err := os.ReadFile(sourceNamePath)
 	if err != nil {
-		err = errors.New("opsmx profile secret validation error: `sourceName` key not present in the secret file\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'sourceName'")
+		err = fmt.Errorf("opsmx profile secret validation error: `sourceName` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'sourceName'", secretsPath)
 		return nil, err
 	}
-	cdIntegrationPath := filepath.Join(basePath, "secrets/cdIntegration")
+	cdIntegrationPath := filepath.Join(secretsPath, "cdIntegration")
 	secretcdintegration, err := os.ReadFile(cdIntegrationPath)
 	if err != nil {
-		err = errors.New("opsmx profile secret validation error: `cdIntegration` key not present in the secret file\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'cdIntegration'")
+		err = fmt.Errorf("opsmx profile secret validation error: `cdIntegration` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'cdIntegration'", secretsPath)
 		return nil, err
 	}
 
-	agentNamePath := filepath.Join(basePath, "secrets/agentName")
+	agentNamePath := filepath.Join(secretsPath, "agentName")
 	secretagentname, err := os.ReadFile(agentNamePath)
 	if err != nil && string(secretcdintegration) == "true" {
-		err = errors.New("opsmx profile secret validation error: `agentName` key not present in the secret file\n Action Required: secret file has to be mounted on '/etc/config/secrets' in AnalysisTemplate and must carry data element 'agentName' for 'cdIntegration' as 'true'")
+		err = fmt.Errorf("opsmx profile secret validation error: `agentName` key not present in the secret file\n Action Required: secret file has to be mounted on '%s' in AnalysisTemplate and must carry data element 'agentName' for 'cdIntegration' as 'true'", secretsPath)
 		return nil, err
 	}
 
+	authData, err := getAuthSecret(secretsPath)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range authData {
+		secretData[key] = value
+	}
+
 	opsmxIsdURL := metric.OpsmxIsdUrl
 	if opsmxIsdURL == "" {
 		opsmxIsdURL = string(opsmxIsdUrl)
@@ -599,7 +676,61 @@ func getScopeValues(scope string) (string, error) {
 	return scopeValue, nil
 }
 
-func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]string, basePath string) (string, error) {
+// Return the validation errors of the log analysis context of a service
+func (metric *OPSMXMetric) logScopeErrors(item OPSMXService, serviceName string) []error {
+	var errs []error
+	if item.LogScopeVariables == "" && item.BaselineLogScope != "" || item.LogScopeVariables == "" && item.CanaryLogScope != "" {
+		errorMsg := fmt.Sprintf("provider config map validation error: missing log Scope placeholder for the provided baseline/canary of service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	if item.LogScopeVariables == "" {
+		return errs
+	}
+	//Check if no baseline or canary
+	if item.BaselineLogScope != "" && item.CanaryLogScope == "" {
+		errorMsg := fmt.Sprintf("provider config map validation error: missing canary for log analysis of service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	//Check if the number of placeholders provided dont match
+	if len(strings.Split(item.LogScopeVariables, ",")) != len(strings.Split(item.BaselineLogScope, ",")) || len(strings.Split(item.LogScopeVariables, ",")) != len(strings.Split(item.CanaryLogScope, ",")) {
+		errorMsg := fmt.Sprintf("provider config map validation error: mismatch in number of log scope variables and baseline/canary log scope of service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	if item.LogTemplateName == "" && metric.GlobalLogTemplate == "" {
+		errorMsg := fmt.Sprintf("provider config map validation error: provide either a service specific log template or global log template for service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	return errs
+}
+
+// Return the validation errors of the metric analysis context of a service
+func (metric *OPSMXMetric) metricScopeErrors(item OPSMXService, serviceName string) []error {
+	var errs []error
+	if item.MetricScopeVariables == "" && item.BaselineMetricScope != "" || item.MetricScopeVariables == "" && item.CanaryMetricScope != "" {
+		errorMsg := fmt.Sprintf("provider config map validation error: missing metric Scope placeholder for the provided baseline/canary of service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	if item.MetricScopeVariables == "" {
+		return errs
+	}
+	//Check if no baseline or canary
+	if item.BaselineMetricScope == "" || item.CanaryMetricScope == "" {
+		errorMsg := fmt.Sprintf("provider config map validation error: missing baseline/canary for metric analysis of service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	//Check if the number of placeholders provided dont match
+	if len(strings.Split(item.MetricScopeVariables, ",")) != len(strings.Split(item.BaselineMetricScope, ",")) || len(strings.Split(item.MetricScopeVariables, ",")) != len(strings.Split(item.CanaryMetricScope, ",")) {
+		errorMsg := fmt.Sprintf("provider config map validation error: mismatch in number of metric scope variables and baseline/canary metric scope of service '%s'", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	if item.MetricTemplateName == "" && metric.GlobalMetricTemplate == "" {
+		errorMsg := fmt.Sprintf("provider config map validation error: provide either a service specific metric template or global metric template for service: %s", serviceName)
+		errs = append(errs, errors.New(errorMsg))
+	}
+	return errs
+}
+
+func (metric *OPSMXMetric) generatePayload(ctx context.Context, c *Clients, secretData map[string]string, templatesPath string) (string, error) {
 	var intervalTime string
 	if metric.IntervalTime != 0 {
 		intervalTime = fmt.Sprintf("%d", metric.IntervalTime)
@@ -610,6 +741,7 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 		opsmxdelay = fmt.Sprintf("%d", metric.Delay)
 	}
 	var services []string
+	isd := c.isdClient(secretData, metric.Retry)
 	//Generate the payload
 	payload := jobPayload{
 		Application: metric.Application,
@@ -622,7 +754,7 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 			IntervalTime:    intervalTime,
 			Delays:          opsmxdelay,
 			CanaryHealthCheckHandler: canaryHealthCheckHandler{
-				MinimumCanaryResultScore: fmt.Sprintf("%d", metric.Pass),
+				MinimumCanaryResultScore: fmt.Sprintf("%d", metric.minimumScore()),
 			},
 			CanarySuccessCriteria: canarySuccessCriteria{
 				CanaryResultScore: fmt.Sprintf("%d", metric.Pass),
@@ -655,39 +787,11 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 			}
 			services = append(services, serviceName)
 			gateName := fmt.Sprintf("gate%d", i+1)
-			if item.LogScopeVariables == "" && item.BaselineLogScope != "" || item.LogScopeVariables == "" && item.CanaryLogScope != "" {
-				errorMsg := fmt.Sprintf("provider config map validation error: missing log Scope placeholder for the provided baseline/canary of service '%s'", serviceName)
-				err := errors.New(errorMsg)
-				if err != nil {
-					return "", err
-				}
+			if errs := metric.logScopeErrors(item, serviceName); len(errs) != 0 {
+				return "", errs[0]
 			}
 			//For Log Analysis is to be added in analysis-run
 			if item.LogScopeVariables != "" {
-				//Check if no baseline or canary
-				if item.BaselineLogScope != "" && item.CanaryLogScope == "" {
-					errorMsg := fmt.Sprintf("provider config map validation error: missing canary for log analysis of service '%s'", serviceName)
-					err := errors.New(errorMsg)
-					if err != nil {
-						return "", err
-					}
-				}
-				//Check if the number of placeholders provided dont match
-				if len(strings.Split(item.LogScopeVariables, ",")) != len(strings.Split(item.BaselineLogScope, ",")) || len(strings.Split(item.LogScopeVariables, ",")) != len(strings.Split(item.CanaryLogScope, ",")) {
-					errorMsg := fmt.Sprintf("provider config map validation error: mismatch in number of log scope variables and baseline/canary log scope of service '%s'", serviceName)
-					err := errors.New(errorMsg)
-					if err != nil {
-						return "", err
-					}
-				}
-				if item.LogTemplateName == "" && metric.GlobalLogTemplate == "" {
-					errorMsg := fmt.Sprintf("provider config map validation error: provide either a service specific log template or global log template for service '%s'", serviceName)
-					err := errors.New(errorMsg)
-					if err != nil {
-						return "", err
-					}
-				}
-
 				baslineLogScope, errors := getScopeValues(item.BaselineLogScope)
 				if errors != nil {
 					return "", errors
@@ -721,7 +825,7 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 				var templateData string
 				var err error
 				if metric.GitOPS && item.LogTemplateVersion == "" {
-					templateData, err = getTemplateData(c.client, secretData, tempName, "LOG", basePath, item.LogScopeVariables)
+					templateData, err = c.processGitopsTemplate(ctx, isd, tempName, "LOG", templatesPath, item.LogScopeVariables)
 					if err != nil {
 						return "", err
 					}
@@ -739,39 +843,11 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 				valid = true
 			}
 
-			if item.MetricScopeVariables == "" && item.BaselineMetricScope != "" || item.MetricScopeVariables == "" && item.CanaryMetricScope != "" {
-				errorMsg := fmt.Sprintf("provider config map validation error: missing metric Scope placeholder for the provided baseline/canary of service '%s'", serviceName)
-				err := errors.New(errorMsg)
-				if err != nil {
-					return "", err
-				}
+			if errs := metric.metricScopeErrors(item, serviceName); len(errs) != 0 {
+				return "", errs[0]
 			}
 			//For metric analysis is to be added in analysis-run
 			if item.MetricScopeVariables != "" {
-				//Check if no baseline or canary
-				if item.BaselineMetricScope == "" || item.CanaryMetricScope == "" {
-					errorMsg := fmt.Sprintf("provider config map validation error: missing baseline/canary for metric analysis of service '%s'", serviceName)
-					err := errors.New(errorMsg)
-					if err != nil {
-						return "", err
-					}
-				}
-				//Check if the number of placeholders provided dont match
-				if len(strings.Split(item.MetricScopeVariables, ",")) != len(strings.Split(item.BaselineMetricScope, ",")) || len(strings.Split(item.MetricScopeVariables, ",")) != len(strings.Split(item.CanaryMetricScope, ",")) {
-					errorMsg := fmt.Sprintf("provider config map validation error: mismatch in number of metric scope variables and baseline/canary metric scope of service '%s'", serviceName)
-					err := errors.New(errorMsg)
-					if err != nil {
-						return "", err
-					}
-				}
-				if item.MetricTemplateName == "" && metric.GlobalMetricTemplate == "" {
-					errorMsg := fmt.Sprintf("provider config map validation error: provide either a service specific metric template or global metric template for service: %s", serviceName)
-					err := errors.New(errorMsg)
-					if err != nil {
-						return "", err
-					}
-				}
-
 				baselineMetricScope, errors := getScopeValues(item.BaselineMetricScope)
 				if errors != nil {
 					return "", errors
@@ -805,7 +881,7 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 				var templateData string
 				var err error
 				if metric.GitOPS && item.MetricTemplateVersion == "" {
-					templateData, err = getTemplateData(c.client, secretData, tempName, "METRIC", basePath, item.MetricScopeVariables)
+					templateData, err = c.processGitopsTemplate(ctx, isd, tempName, "METRIC", templatesPath, item.MetricScopeVariables)
 					if err != nil {
 						return "", err
 					}
@@ -845,53 +921,66 @@ func (metric *OPSMXMetric) generatePayload(c *Clients, secretData map[string]str
 	return string(buffer), err
 }
 
-// Evaluate canaryScore and accordingly set the AnalysisPhase
-func evaluateResult(score int, pass int) string {
+// Services whose gate scored below the passScore set on the service, the overall score is evaluated by processResume
+func (metric *OPSMXMetric) failedGates(results []ServiceResult) ([]string, error) {
+	var failed []string
+	for i, item := range metric.Services {
+		if item.PassScore == 0 {
+			continue
+		}
+		serviceName := fmt.Sprintf("service%d", i+1)
+		if item.ServiceName != "" {
+			serviceName = item.ServiceName
+		}
+		gateName := fmt.Sprintf("gate%d", i+1)
+		var serviceScore Score
+		for _, result := range results {
+			if result.ServiceGate == gateName || result.ServiceName == serviceName {
+				serviceScore = result.ServiceScore
+				break
+			}
+		}
+		if serviceScore == "" {
+			errorMsg := fmt.Sprintf("analysis Error: score of service %s (%s) not found in the canary Response", serviceName, gateName)
+			return nil, errors.New(errorMsg)
+		}
+		score, err := serviceScore.value()
+		if err != nil {
+			return nil, err
+		}
+		if score < item.PassScore {
+			failed = append(failed, fmt.Sprintf("service %s (%s) scored %d below its passScore %d", serviceName, gateName, score, item.PassScore))
+		}
+	}
+	return failed, nil
+}
+
+// Score below which ISD marks the canary as unhealthy, the marginal score when an Inconclusive band is set
+func (metric *OPSMXMetric) minimumScore() int {
+	if metric.Marginal != 0 {
+		return metric.Marginal
+	}
+	return metric.Pass
+}
+
+// Evaluate canaryScore and accordingly set the AnalysisPhase, scores from marginal up to pass are Inconclusive
+func evaluateResult(score int, pass int, marginal int) string {
 	if score >= pass {
 		return "Successful"
 	}
+	if marginal != 0 && score >= marginal {
+		return "Inconclusive"
+	}
 	return "Failed"
 }
 
-// Extract the canaryScore and evaluateResult
-func (metric *OPSMXMetric) processResume(data []byte) (string, string, error) {
-	var (
-		canaryScore string
-		result      map[string]interface{}
-		finalScore  map[string]interface{}
-	)
-
-	err := json.Unmarshal(data, &result)
-	if err != nil {
-		errorMessage := fmt.Sprintf("analysis Error: Error in post processing canary Response. Error: %v", err)
-		return "", "", errors.New(errorMessage)
-	}
-	jsonBytes, _ := json.MarshalIndent(result["canaryResult"], "", "   ")
-	err = json.Unmarshal(jsonBytes, &finalScore)
+// Extract the canaryScore of the result of a finished canary and evaluateResult
+func (metric *OPSMXMetric) processResume(result CanaryResult) (string, string, error) {
+	score, err := result.OverallScore.value()
 	if err != nil {
 		return "", "", err
 	}
-	if finalScore["overallScore"] == nil {
-		canaryScore = "0"
-	} else {
-		canaryScore = fmt.Sprintf("%v", finalScore["overallScore"])
-	}
-
-	var score int
-	// var err error
-	if strings.Contains(canaryScore, ".") {
-		floatScore, err := strconv.ParseFloat(canaryScore, 64)
-		if err != nil {
-			return "", "", err
-		}
-		score = int(roundFloat(floatScore, 0))
-	} else {
-		score, err = strconv.Atoi(canaryScore)
-		if err != nil {
-			return "", "", err
-		}
-	}
 
-	Phase := evaluateResult(score, int(metric.Pass))
+	Phase := evaluateResult(score, int(metric.Pass), metric.Marginal)
 	return Phase, fmt.Sprintf("%v", score), nil
 }
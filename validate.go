@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ValidationReport collects the validation errors of a config directory grouped by where they were found
+type ValidationReport struct {
+	groups []string
+	errors map[string][]error
+}
+
+func newValidationReport() *ValidationReport {
+	return &ValidationReport{
+		errors: map[string][]error{},
+	}
+}
+
+func (v *ValidationReport) add(group string, errs ...error) {
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if _, ok := v.errors[group]; !ok {
+			v.groups = append(v.groups, group)
+		}
+		v.errors[group] = append(v.errors[group], err)
+	}
+}
+
+func (v *ValidationReport) count() int {
+	count := 0
+	for _, errs := range v.errors {
+		count += len(errs)
+	}
+	return count
+}
+
+func (v *ValidationReport) print(out io.Writer) {
+	for _, group := range v.groups {
+		fmt.Fprintf(out, "%s:\n", group)
+		for _, err := range v.errors[group] {
+			fmt.Fprintf(out, "  - %v\n", err)
+		}
+	}
+	if v.count() == 0 {
+		fmt.Fprintln(out, "no validation errors found")
+		return
+	}
+	fmt.Fprintf(out, "found %d validation error(s)\n", v.count())
+}
+
+// Run every provider config, secret and gitops template check offline without stopping at the first error
+func validateConfig(paths ConfigPaths) *ValidationReport {
+	report := newValidationReport()
+	providerGroup := "providerConfig"
+	metric, err := getAnalysisTemplateData(paths.providerConfig)
+	if err != nil {
+		report.add(providerGroup, err)
+		return report
+	}
+	report.add(providerGroup, metric.basicCheckErrors()...)
+	report.add(providerGroup, metric.getTimeVariables())
+
+	//secrets are usually not kept along with the config in git, check them only if mounted
+	if _, err := os.Stat(paths.secrets); err == nil {
+		_, err = metric.getDataSecret(paths.secrets)
+		report.add("secrets", err)
+		_, err = getTLSConfig(paths.secrets)
+		report.add("secrets", err)
+	}
+
+	if len(metric.Services) == 0 {
+		report.add(providerGroup, errors.New("provider config map validation error: no services provided"))
+	}
+	var services []string
+	validated := map[string]bool{}
+	validateTemplate := func(template string, templateType string, scopeVariables string) {
+		if !metric.GitOPS || template == "" || validated[templateType+"/"+template] {
+			return
+		}
+		validated[templateType+"/"+template] = true
+		_, err := getTemplateJson(template, templateType, paths.templates, scopeVariables)
+		report.add(fmt.Sprintf("template '%s'", template), err)
+	}
+	for i, item := range metric.Services {
+		serviceName := fmt.Sprintf("service%d", i+1)
+		if item.ServiceName != "" {
+			serviceName = item.ServiceName
+		}
+		serviceGroup := fmt.Sprintf("service '%s'", serviceName)
+		if isExists(services, serviceName) {
+			errorMsg := fmt.Sprintf("provider config map validation error: serviceName '%s' mentioned in provider Config exists more than once", serviceName)
+			report.add(serviceGroup, errors.New(errorMsg))
+		}
+		services = append(services, serviceName)
+		report.add(serviceGroup, metric.logScopeErrors(item, serviceName)...)
+		report.add(serviceGroup, metric.metricScopeErrors(item, serviceName)...)
+		if item.LogScopeVariables == "" && item.MetricScopeVariables == "" {
+			report.add(serviceGroup, errors.New("provider config map validation error: at least one of log or metric context must be provided"))
+		}
+
+		if item.LogScopeVariables != "" && item.LogTemplateVersion == "" {
+			tempName := item.LogTemplateName
+			if tempName == "" {
+				tempName = metric.GlobalLogTemplate
+			}
+			validateTemplate(tempName, "LOG", item.LogScopeVariables)
+		}
+		if item.MetricScopeVariables != "" && item.MetricTemplateVersion == "" {
+			tempName := item.MetricTemplateName
+			if tempName == "" {
+				tempName = metric.GlobalMetricTemplate
+			}
+			validateTemplate(tempName, "METRIC", item.MetricScopeVariables)
+		}
+	}
+	return report
+}
+
+// Entry point of the validate subcommand, returns the exit code of the process
+func validateCommand(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate [config directory]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	basePath := defaultBasePath
+	if fs.NArg() > 0 {
+		basePath = fs.Arg(0)
+	}
+	log.SetLevel(log.WarnLevel)
+
+	report := validateConfig(newConfigPaths(basePath))
+	report.print(out)
+	if report.count() != 0 {
+		return 1
+	}
+	return 0
+}